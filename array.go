@@ -0,0 +1,165 @@
+package phpserialize
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// ArrayElement is a single element of an OrderedArray. The Key is an int64 or
+// a string.
+type ArrayElement struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// OrderedArray is a PHP array with its elements in the order that they were
+// serialized. Unlike a map, Marshal will encode the elements in the same order,
+// so that decoding and encoding an array does not change it. Arrays are decoded
+// as an *OrderedArray when the OrderedArrays option is enabled, or when
+// decoding into an OrderedArray.
+type OrderedArray struct {
+	Elements []ArrayElement
+}
+
+// Len returns the number of elements.
+func (a *OrderedArray) Len() int {
+	return len(a.Elements)
+}
+
+// Get returns the value for the key. The second return value is false if there
+// is no element with the key.
+//
+// Keys are converted the same way as PHP converts array keys, so "5", 5 and
+// int64(5) are all the same key.
+func (a *OrderedArray) Get(key interface{}) (interface{}, bool) {
+	key = orderedArrayKey(key)
+	for _, element := range a.Elements {
+		if orderedArrayKey(element.Key) == key {
+			return element.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// Set changes the value for the key. A new element is added to the end if there
+// is no element with the key. Keys are converted the same way as Get.
+func (a *OrderedArray) Set(key, value interface{}) {
+	key = orderedArrayKey(key)
+	for i := range a.Elements {
+		if orderedArrayKey(a.Elements[i].Key) == key {
+			a.Elements[i].Value = value
+			return
+		}
+	}
+
+	a.Elements = append(a.Elements, ArrayElement{key, value})
+}
+
+// orderedArrayKey returns the int64 or string key that PHP would use for key.
+// Keys that PHP can not use are returned as they are, Marshal will return an
+// error for them.
+func orderedArrayKey(key interface{}) interface{} {
+	k, err := phpArrayKey(reflect.ValueOf(key))
+	if err != nil {
+		return key
+	}
+
+	return k.Interface()
+}
+
+var orderedArrayType = reflect.TypeOf(OrderedArray{})
+
+// fillOrderedArray consumes an array into v, which is an OrderedArray.
+func (d *decodeState) fillOrderedArray(offset int, v reflect.Value) (int, error) {
+	headerOffset, err := d.consumeHeader(offset, 'a', "array")
+	if err != nil {
+		return -1, err
+	}
+
+	d.addSlot(offset, v)
+
+	var result OrderedArray
+	offset, err = d.consumeOrderedElements(headerOffset, &result)
+	if err != nil {
+		return -1, err
+	}
+
+	v.Set(reflect.ValueOf(result))
+
+	return offset, nil
+}
+
+// consumeOrderedElements consumes the number of elements of an array and then
+// each of the elements in order.
+func (d *decodeState) consumeOrderedElements(offset int,
+	result *OrderedArray) (int, error) {
+	length, offset, err := d.consumeCount(offset, mapElementSize)
+	if err != nil {
+		return -1, err
+	}
+
+	result.Elements = make([]ArrayElement, 0, d.preallocate(offset, length))
+
+	for i := 0; i < length; i++ {
+		var key, value interface{}
+
+		key, offset, err = d.consumeKey(offset)
+		if err != nil {
+			return -1, err
+		}
+
+		d.pushPath(key)
+		value, offset, err = d.consumeNext(offset)
+		if err != nil {
+			return -1, err
+		}
+		d.popPath()
+
+		result.Elements = append(result.Elements, ArrayElement{key, value})
+	}
+
+	return d.consumeEnd(offset)
+}
+
+func (e *encodeState) marshalOrderedArray(a OrderedArray) error {
+	// The keys are checked before anything is written, the same as they
+	// are for a map.
+	keys := make([]reflect.Value, len(a.Elements))
+	seen := map[interface{}]bool{}
+	for i, element := range a.Elements {
+		key, err := e.arrayKey(reflect.ValueOf(element.Key))
+		if err != nil {
+			return err
+		}
+
+		if !e.options.LiteralKeys {
+			if seen[key.Interface()] {
+				return fmt.Errorf("duplicate array key %v in %s",
+					key.Interface(), orderedArrayType)
+			}
+
+			seen[key.Interface()] = true
+		}
+
+		keys[i] = key
+	}
+
+	e.writeArrayHeader(len(a.Elements))
+
+	for i, element := range a.Elements {
+		err := e.marshalValue(keys[i].Interface())
+		if err != nil {
+			return err
+		}
+
+		err = e.marshal(element.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	e.w.WriteByte('}')
+
+	return nil
+}
@@ -0,0 +1,141 @@
+package phpserialize_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/elliotchance/phpserialize"
+)
+
+func TestUnmarshalOrderedArrays(t *testing.T) {
+	data := `a:2:{i:0;a:3:{s:1:"z";i:1;i:5;s:1:"a";s:1:"b";a:1:{i:0;b:1;}}i:1;r:2;}`
+
+	options := phpserialize.DefaultDecodeOptions()
+	options.OrderedArrays = true
+
+	var result []interface{}
+	err := phpserialize.UnmarshalWithOptions([]byte(data), &result, options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	// Lists are still decoded as slices.
+	expected := &phpserialize.OrderedArray{
+		Elements: []phpserialize.ArrayElement{
+			{"z", int64(1)},
+			{int64(5), "a"},
+			{"b", []interface{}{true}},
+		},
+	}
+	if !reflect.DeepEqual(result[0], expected) {
+		t.Errorf("Expected %#+v, got %#+v", expected, result[0])
+	}
+
+	if result[1] != result[0] {
+		t.Errorf("Expected the reference to be the same array, got %#+v",
+			result[1])
+	}
+}
+
+func TestMarshalOrderedArray(t *testing.T) {
+	data := `a:3:{s:1:"z";i:1;i:5;s:1:"a";s:1:"b";N;}`
+
+	var result phpserialize.OrderedArray
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if value, ok := result.Get(int64(5)); !ok || value != "a" {
+		t.Errorf("Expected \"a\", got %#+v", value)
+	}
+
+	result.Set("b", 1.5)
+	result.Set("c", "d")
+
+	out, err := phpserialize.Marshal(result, nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := `a:4:{s:1:"z";i:1;i:5;s:1:"a";s:1:"b";d:1.5;s:1:"c";s:1:"d";}`
+	if string(out) != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+}
+
+func TestOrderedArrayKeysAreConverted(t *testing.T) {
+	var a phpserialize.OrderedArray
+	a.Set("5", 1)
+	a.Set(int64(5), 2)
+	a.Set(5, 3)
+	a.Set(nil, 4)
+	a.Set("", 5)
+
+	for _, key := range []interface{}{"5", 5, int64(5), 5.5} {
+		if value, ok := a.Get(key); !ok || value != 3 {
+			t.Errorf("Expected 3 for %#+v, got %#+v", key, value)
+		}
+	}
+
+	if value, ok := a.Get(true); ok {
+		t.Errorf("Expected no element for true, got %#+v", value)
+	}
+
+	out, err := phpserialize.Marshal(a, nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := `a:2:{i:5;i:3;s:0:"";i:5;}`
+	if string(out) != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+}
+
+func TestUnmarshalOrderedArrayField(t *testing.T) {
+	type holder struct {
+		Values phpserialize.OrderedArray
+	}
+
+	data := `O:6:"holder":1:{s:6:"values";a:2:{i:1;s:1:"x";i:0;s:1:"y";}}`
+
+	var result holder
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := []phpserialize.ArrayElement{
+		{int64(1), "x"},
+		{int64(0), "y"},
+	}
+	if !reflect.DeepEqual(result.Values.Elements, expected) {
+		t.Errorf("Expected %#+v, got %#+v", expected, result.Values.Elements)
+	}
+}
+
+func TestOrderedArrayReferenceRoundTrip(t *testing.T) {
+	// A reference to an array is a value reference, even when the array is
+	// an *OrderedArray.
+	data := `a:2:{s:1:"a";a:1:{s:1:"x";i:1;}s:1:"b";R:2;}`
+
+	options := phpserialize.DefaultDecodeOptions()
+	options.OrderedArrays = true
+
+	var result interface{}
+	err := phpserialize.UnmarshalWithOptions([]byte(data), &result, options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	marshalOptions := phpserialize.DefaultMarshalOptions()
+	marshalOptions.References = true
+
+	out, err := phpserialize.Marshal(result, marshalOptions)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if string(out) != data {
+		t.Errorf("Expected %q, got %q", data, out)
+	}
+
+	// The numbering continues after the value reference.
+	array := &phpserialize.OrderedArray{}
+	array.Set("x", 1)
+	out, err = phpserialize.Marshal([]interface{}{array, array, array},
+		marshalOptions)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := `a:3:{i:0;a:1:{s:1:"x";i:1;}i:1;R:2;i:2;R:2;}`
+	if string(out) != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+}
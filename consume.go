@@ -1,7 +1,6 @@
 package phpserialize
 
 import (
-	"errors"
 	"reflect"
 	"strconv"
 )
@@ -9,375 +8,1537 @@ import (
 // The internal consume functions work as the parser/lexer when reading
 // individual items off the serialized stream.
 
-// consumeStringUntilByte will return a string that includes all characters
-// after the given offset, but only up until (and not including) a found byte.
+// decodeState holds everything that must be shared between the consume
+// functions while decoding a single serialized value.
+type decodeState struct {
+	*decodeInput
+
+	// slots records every value in the order that PHP numbers them. This is
+	// needed to resolve object references ("r:N;") and value references
+	// ("R:N;"). PHP starts counting at 1 so "r:1;" refers to slot 0. Use
+	// slot() and slotCount() rather than slots directly.
+	slots []slot
+
+	// A replay shares the first parentSlots slots of its parent instead of
+	// copying them. slots only holds the slots that come after them.
+	parent      *decodeState
+	parentSlots int
+
+	// replayed holds the values that references were decoded into when
+	// they had to be decoded again. It is shared with replays so that each
+	// value is only decoded again once for each Go type.
+	replayed map[replayKey]reflect.Value
+
+	// registry is used to find the decoders for custom serialized objects.
+	registry *Registry
+
+	// path holds the keys of the arrays and objects that the current value
+	// is inside of, so that errors can describe where they happened.
+	path []interface{}
+
+	options *DecodeOptions
+
+	// depth is the number of arrays and objects that the current value is
+	// inside of.
+	depth int
+
+	// usage is shared with replays so that references can not be used to
+	// get around the limits in options.
+	usage *decodeUsage
+
+	// lastOffset and lastKind are the offset and type byte of the last value
+	// that consumeNext consumed. When decoding from a Decoder the start of
+	// the value may have been discarded before an error can describe it.
+	lastOffset int
+	lastKind   byte
+}
+
+// decodeInput is the serialized data that is being decoded. It is shared with
+// replays.
+//
+// Unmarshal has all of the data, but a Decoder only has a window of the
+// stream in memory: data begins at the offset base, and reading more of the
+// stream (see fill) discards everything before the value that is being
+// consumed. Offsets are always from the start of the value that is being
+// decoded, not from the start of data.
+type decodeInput struct {
+	data []byte
+	base int
+
+	// dec is the Decoder that more data is read from, or nil if data is
+	// all of the data.
+	dec *Decoder
+
+	// mark is where the innermost value that is being consumed starts.
+	// Nothing from mark onwards is discarded.
+	mark int
+
+	// While pinned is true nothing from pin onwards is discarded, and data
+	// is not moved, so that slices of it can be used. See hold.
+	pin    int
+	pinned bool
+}
+
+// inputHold is what hold returns so that release can restore it.
+type inputHold struct {
+	pin    int
+	pinned bool
+	mark   int
+}
+
+// maxInt is the largest value of an int.
+const maxInt = int(^uint(0) >> 1)
+
+// replayKey identifies a value that was decoded again by a reference, by its
+// slot and the Go type that it was decoded into.
+type replayKey struct {
+	index int
+	t     reflect.Type
+}
+
+// decodeUsage is the total of everything that is limited by DecodeOptions,
+// except for depth.
+type decodeUsage struct {
+	elements int
+	bytes    int
+}
+
+// slot is a single numbered value. The offset is where the value starts in
+// the serialized data. The value is what it was decoded into, which may be
+// invalid if the value was skipped.
 //
-// This function will only work with a plain, non-encoded series of bytes. It
-// should not be used to capture anything other that ASCII data that is
-// terminated by a single byte.
-func consumeStringUntilByte(data []byte, lookingFor byte, offset int) (s string, newOffset int) {
-	newOffset = findByte(data, lookingFor, offset)
-	if newOffset < 0 {
-		return "", -1
+// Values that were decoded without a Go type to guide them (into interface{})
+// are stored as an interface{} so they can be told apart from values that were
+// decoded into a concrete type.
+type slot struct {
+	offset int
+	value  reflect.Value
+}
+
+var interfaceType = reflect.TypeOf((*interface{})(nil)).Elem()
+
+// int64Type is the type of PHP integers. Integers that do not fit in it are
+// not valid.
+var int64Type = reflect.TypeOf(int64(0))
+
+// mapElementSize is roughly the memory used for each element of a
+// map[interface{}]interface{}.
+const mapElementSize = 2 * 16
+
+func newDecodeState(data []byte, options *DecodeOptions) *decodeState {
+	if options == nil {
+		options = DefaultDecodeOptions()
+	}
+
+	registry := options.Registry
+	if registry == nil {
+		registry = DefaultRegistry
+	}
+
+	return &decodeState{
+		decodeInput: &decodeInput{data: data},
+		registry:    registry,
+		options:     options,
+		replayed:    map[replayKey]reflect.Value{},
+		usage:       new(decodeUsage),
+	}
+}
+
+// addSlot records the next numbered value and returns its index so that
+// containers can register themselves before their elements are consumed.
+func (d *decodeState) addSlot(offset int, value reflect.Value) int {
+	d.slots = append(d.slots, slot{offset, value})
+
+	return d.slotCount() - 1
+}
+
+// slot returns the slot at index, which may belong to the parent of a replay.
+func (d *decodeState) slot(index int) *slot {
+	if index < d.parentSlots {
+		return d.parent.slot(index)
+	}
+
+	return &d.slots[index-d.parentSlots]
+}
+
+// slotCount is the number of values that have been numbered so far.
+func (d *decodeState) slotCount() int {
+	return d.parentSlots + len(d.slots)
+}
+
+// addGenericSlot is the same as addSlot for values decoded into interface{}.
+func (d *decodeState) addGenericSlot(offset int, value interface{}) int {
+	return d.addSlot(offset, genericValue(value))
+}
+
+func genericValue(value interface{}) reflect.Value {
+	v := reflect.New(interfaceType).Elem()
+	if value != nil {
+		v.Set(reflect.ValueOf(value))
+	}
+
+	return v
+}
+
+// end is the offset after the last byte of data.
+func (in *decodeInput) end() int {
+	return in.base + len(in.data)
+}
+
+// fill makes sure that data contains everything before end, by reading more
+// of the stream if there is a Decoder. It returns false if the data ends first.
+func (in *decodeInput) fill(end int) bool {
+	for in.end() < end {
+		if in.dec == nil || !in.dec.readMore(in) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// byteAt returns the byte at offset, or 0 if the data ends before it.
+func (in *decodeInput) byteAt(offset int) byte {
+	if offset < in.base || !in.fill(offset+1) {
+		return 0
+	}
+
+	return in.data[offset-in.base]
+}
+
+// isType returns true if the value at offset has the type t, such as 'a'.
+func (in *decodeInput) isType(offset int, t byte) bool {
+	return in.byteAt(offset) == t
+}
+
+// bytes returns the data from start to end, which must already be filled.
+func (in *decodeInput) bytes(start, end int) []byte {
+	return in.data[start-in.base : end-in.base]
+}
+
+// find returns the offset of the first c at or after offset, or -1 if the data
+// ends first.
+func (in *decodeInput) find(c byte, offset int) int {
+	for {
+		if i := findByte(in.data, c, offset-in.base); i >= 0 {
+			return in.base + i
+		}
+
+		offset = in.end()
+		if !in.fill(offset + 1) {
+			return -1
+		}
+	}
+}
+
+// keep is the offset of the first byte that can not be discarded.
+func (in *decodeInput) keep() int {
+	if in.pinned && in.pin < in.mark {
+		return in.pin
+	}
+
+	return in.mark
+}
+
+// hold stops the data from offset onwards from being discarded or moved until
+// release is called. It is used to pass a slice of the data to something else,
+// and to decode a value before the current one again.
+func (in *decodeInput) hold(offset int) inputHold {
+	h := inputHold{in.pin, in.pinned, in.mark}
+	if !in.pinned || offset < in.pin {
+		in.pin = offset
+	}
+	in.pinned = true
+
+	return h
+}
+
+// release undoes hold. The mark is restored as well, because the values that
+// were consumed while holding may be after the value that the caller
+// continues with.
+func (in *decodeInput) release(h inputHold) {
+	in.pin, in.pinned, in.mark = h.pin, h.pinned, h.mark
+}
+
+// expectByte checks that the byte at offset is c and returns the offset after
+// it.
+func (d *decodeState) expectByte(offset int, c byte) (int, error) {
+	if d.byteAt(offset) != c {
+		return -1, d.syntaxError(offset, strconv.Quote(string(c)))
+	}
+
+	return offset + 1, nil
+}
+
+// consumeUntil returns the text from offset up to the next terminator and the
+// offset after the terminator.
+func (d *decodeState) consumeUntil(offset int, terminator byte) (string, int, error) {
+	end := d.find(terminator, offset)
+	if end < 0 {
+		return "", -1, d.syntaxError(d.end(), strconv.Quote(string(terminator)))
+	}
+
+	return string(d.bytes(offset, end)), end + 1, nil
+}
+
+func (d *decodeState) consumeInt(offset int) (int64, int, error) {
+	offset, err := d.consumeHeader(offset, 'i', "integer")
+	if err != nil {
+		return 0, -1, err
+	}
+
+	alphaNumber, newOffset, err := d.consumeUntil(offset, ';')
+	if err != nil {
+		return 0, -1, err
+	}
+
+	i, err := strconv.ParseInt(alphaNumber, 10, 64)
+	if err != nil {
+		if err.(*strconv.NumError).Err == strconv.ErrRange {
+			return 0, -1, d.overflowError(offset-2, alphaNumber, int64Type)
+		}
+
+		return 0, -1, d.numberError(offset, "integer", alphaNumber)
+	}
+
+	return i, newOffset, nil
+}
+
+func (d *decodeState) consumeFloat(offset int) (float64, int, error) {
+	offset, err := d.consumeHeader(offset, 'd', "float")
+	if err != nil {
+		return 0, -1, err
+	}
+
+	alphaNumber, newOffset, err := d.consumeUntil(offset, ';')
+	if err != nil {
+		return 0, -1, err
+	}
+
+	v, ok := parseFloat(alphaNumber)
+	if !ok {
+		return 0, -1, d.numberError(offset, "float", alphaNumber)
+	}
+
+	return v, newOffset, nil
+}
+
+func (d *decodeState) consumeString(offset int) (string, int, error) {
+	offset, err := d.consumeHeader(offset, 's', "string")
+	if err != nil {
+		return "", -1, err
+	}
+
+	return d.consumeStringRealPart(offset, ';')
+}
+
+// consumeIntPart will consume an integer followed by and including a colon.
+// This is used in many places to describe the number of elements or an upcoming
+// length.
+func (d *decodeState) consumeIntPart(offset int) (int, int, error) {
+	rawValue, newOffset, err := d.consumeUntil(offset, ':')
+	if err != nil {
+		return 0, -1, err
+	}
+
+	value, err := strconv.Atoi(rawValue)
+	if err != nil {
+		return 0, -1, d.numberError(offset, "integer", rawValue)
+	}
+
+	return value, newOffset, nil
+}
+
+// consumeStringRealPart consumes the length and quoted string that is used for
+// both strings and class names. The terminator is the byte that must follow
+// the closing quote: ';' for a string or ':' for a class name.
+func (d *decodeState) consumeStringRealPart(offset int, terminator byte) (string, int, error) {
+	lengthOffset := offset
+	length, offset, err := d.consumeIntPart(offset)
+	if err != nil {
+		return "", -1, err
+	}
+
+	if length < 0 {
+		return "", -1, d.numberError(lengthOffset, "length",
+			strconv.Itoa(length))
+	}
+
+	if err := d.allocateString(lengthOffset, length); err != nil {
+		return "", -1, err
+	}
+
+	// Skip over the '"' at the start of the string. I'm not sure why they
+	// decided to wrap the string in double quotes since it's totally
+	// redundant.
+	offset, err = d.expectByte(offset, '"')
+	if err != nil {
+		return "", -1, err
+	}
+
+	// PHP does not escape anything in a string. The length is the exact
+	// number of bytes so the string can contain anything, including quotes.
+	// The length is checked before it is added to the offset so that a huge
+	// length can not overflow.
+	if length > maxInt-offset || !d.fill(offset+length) {
+		return "", -1, d.syntaxError(d.end(), `"\""`)
+	}
+
+	s := string(d.bytes(offset, offset+length))
+
+	newOffset, err := d.expectByte(offset+length, '"')
+	if err != nil {
+		return "", -1, err
+	}
+
+	newOffset, err = d.expectByte(newOffset, terminator)
+	if err != nil {
+		return "", -1, err
+	}
+
+	return s, newOffset, nil
+}
+
+// consumeCount reads the number of elements in an array or object and the '{'
+// that follows it. The count can not be more than the number of elements that
+// could fit in the rest of the data, so that a corrupt count can not be used to
+// allocate a huge amount of memory.
+//
+// The elementSize is how many bytes will be allocated for each element. Each
+// call must be paired with a consumeEnd.
+func (d *decodeState) consumeCount(offset int, elementSize uintptr) (int, int, error) {
+	countOffset := offset
+	count, offset, err := d.consumeIntPart(offset)
+	if err != nil {
+		return 0, -1, err
+	}
+
+	offset, err = d.expectByte(offset, '{')
+	if err != nil {
+		return 0, -1, err
+	}
+
+	// The smallest possible element is "i:0;N;". A Decoder has not read the
+	// rest of the data yet, so only the elements that it reads are allocated
+	// (see preallocate).
+	max := (d.end() - offset) / 6
+	if d.dec != nil {
+		max = (maxInt - offset) / 6
+	}
+
+	if count < 0 || count > max {
+		return 0, -1, d.numberError(countOffset,
+			"count from 0 to "+strconv.Itoa(max), strconv.Itoa(count))
+	}
+
+	d.depth++
+	if max := d.options.MaxDepth; max > 0 && d.depth > max {
+		return 0, -1, d.limitError(countOffset, "MaxDepth", max)
+	}
+
+	d.usage.elements += count
+	if max := d.options.MaxElements; max > 0 && d.usage.elements > max {
+		return 0, -1, d.limitError(countOffset, "MaxElements", max)
+	}
+
+	size := count * int(elementSize)
+	if elementSize > 0 && count > maxInt/int(elementSize) {
+		size = maxInt
+	}
+
+	err = d.allocate(countOffset, size)
+	if err != nil {
+		return 0, -1, err
+	}
+
+	return count, offset, nil
+}
+
+// consumeEnd consumes the '}' at the end of an array or object.
+func (d *decodeState) consumeEnd(offset int) (int, error) {
+	d.depth--
+
+	return d.expectByte(offset, '}')
+}
+
+// allocateString checks that a string, class name or custom object payload of
+// length bytes is within the limits.
+func (d *decodeState) allocateString(offset, length int) error {
+	if max := d.options.MaxStringLength; max > 0 && length > max {
+		return d.limitError(offset, "MaxStringLength", max)
+	}
+
+	return d.allocate(offset, length)
+}
+
+// allocate records that size bytes are going to be allocated.
+func (d *decodeState) allocate(offset, size int) error {
+	if max := d.options.MaxBytes; max > 0 && size > max-d.usage.bytes {
+		return d.limitError(offset, "MaxBytes", max)
+	}
+
+	d.usage.bytes += size
+
+	return nil
+}
+
+// preallocate returns how many of the count elements of an array, starting at
+// offset, should be allocated before they are consumed. A Decoder can not check
+// the count against the rest of the data, so it only allocates as many
+// elements as the data that has been read could hold, and the rest as they are
+// consumed.
+func (d *decodeState) preallocate(offset, count int) int {
+	if max := (d.end() - offset) / 6; d.dec != nil && count > max {
+		return max
+	}
+
+	return count
+}
+
+// consumeHeader checks that the value at offset has the type t, and returns
+// the offset after the ':' that follows it.
+func (d *decodeState) consumeHeader(offset int, t byte, expected string) (int, error) {
+	if !d.isType(offset, t) {
+		return -1, d.syntaxError(offset, expected)
+	}
+
+	return d.expectByte(offset+1, ':')
+}
+
+func (d *decodeState) consumeNil(offset int) (interface{}, int, error) {
+	if !d.isType(offset, 'N') {
+		return nil, -1, d.syntaxError(offset, "null")
+	}
+
+	offset, err := d.expectByte(offset+1, ';')
+	if err != nil {
+		return nil, -1, err
+	}
+
+	return nil, offset, nil
+}
+
+func (d *decodeState) consumeBool(offset int) (bool, int, error) {
+	offset, err := d.consumeHeader(offset, 'b', "boolean")
+	if err != nil {
+		return false, -1, err
+	}
+
+	c := d.byteAt(offset)
+	if c != '0' && c != '1' {
+		return false, -1, d.syntaxError(offset, `"0" or "1"`)
+	}
+
+	value := c == '1'
+
+	offset, err = d.expectByte(offset+1, ';')
+	if err != nil {
+		return false, -1, err
+	}
+
+	return value, offset, nil
+}
+
+// consumeKey reads the key of an array element. PHP only permits integers and
+// strings as keys. Unlike values, keys are not numbered so they can never be
+// the target of a reference.
+func (d *decodeState) consumeKey(offset int) (interface{}, int, error) {
+	if d.isType(offset, 'i') {
+		return d.consumeInt(offset)
+	}
+
+	if d.isType(offset, 's') {
+		return d.consumeString(offset)
+	}
+
+	return nil, -1, d.syntaxError(offset, "integer or string key")
+}
+
+// consumeReferenceIndex reads a "r:N;" or "R:N;" and returns the slot that it
+// refers to.
+func (d *decodeState) consumeReferenceIndex(offset int) (int, int, error) {
+	if !d.isType(offset, 'r') && !d.isType(offset, 'R') {
+		return 0, -1, d.syntaxError(offset, "reference")
+	}
+
+	offset, err := d.expectByte(offset+1, ':')
+	if err != nil {
+		return 0, -1, err
+	}
+
+	rawIndex, newOffset, err := d.consumeUntil(offset, ';')
+	if err != nil {
+		return 0, -1, err
+	}
+
+	index, err := strconv.Atoi(rawIndex)
+	if err != nil {
+		return 0, -1, d.numberError(offset, "integer", rawIndex)
+	}
+
+	if index < 1 || index > d.slotCount() {
+		return 0, -1, d.numberError(offset,
+			"reference from 1 to "+strconv.Itoa(d.slotCount()), rawIndex)
+	}
+
+	return index - 1, newOffset, nil
+}
+
+// consumeReference resolves a reference into a generic value.
+//
+// Objects (maps) are returned as the same map that the original value was
+// decoded into, so identity and cycles are preserved. References to scalars
+// can only be copied.
+func (d *decodeState) consumeReference(offset int) (interface{}, int, error) {
+	index, newOffset, err := d.consumeReferenceIndex(offset)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	s := *d.slot(index)
+
+	// An object reference takes up a slot of its own, a value reference
+	// does not.
+	isObjectReference := d.isType(offset, 'r')
+
+	var value interface{}
+	if s.value.IsValid() && s.value.Kind() == reflect.Interface {
+		value = s.value.Interface()
+	} else if replayed, ok := d.replayed[replayKey{index, interfaceType}]; ok {
+		value = replayed.Interface()
+	} else {
+		// The original value was decoded into a concrete Go type, so
+		// we have to read it again without one.
+		if s.offset < d.base {
+			return nil, -1, d.discardedError(offset, interfaceType)
+		}
+
+		h := d.hold(offset)
+		value, _, err = d.replay(index).consumeNext(s.offset)
+		d.release(h)
+		if err != nil {
+			return nil, -1, err
+		}
+
+		d.replayed[replayKey{index, interfaceType}] = genericValue(value)
+	}
+
+	if isObjectReference {
+		d.addSlot(s.offset, genericValue(value))
+	}
+
+	return value, newOffset, nil
+}
+
+// setReference resolves a reference into a value with a concrete type.
+//
+// Wherever possible the original Go value is shared: maps and pointers are
+// assigned directly and a pointer target will point to the original struct.
+// Otherwise the referenced value is decoded again into a value of the same
+// type as the target. That value is kept so that other references of the same
+// type can use it, otherwise nested references would be decoded again an
+// exponential number of times.
+func (d *decodeState) setReference(offset int, v reflect.Value) (int, error) {
+	index, newOffset, err := d.consumeReferenceIndex(offset)
+	if err != nil {
+		return -1, err
+	}
+
+	s := *d.slot(index)
+	isObjectReference := d.isType(offset, 'r')
+
+	switch {
+	case s.value.IsValid() && s.value.Type().AssignableTo(v.Type()):
+		v.Set(s.value)
+
+	case s.value.IsValid() && s.value.Kind() == reflect.Interface &&
+		!s.value.IsNil() && s.value.Elem().Type().AssignableTo(v.Type()):
+		v.Set(s.value.Elem())
+
+	case v.Kind() == reflect.Ptr && s.value.IsValid() && s.value.CanAddr() &&
+		s.value.Addr().Type().AssignableTo(v.Type()):
+		v.Set(s.value.Addr())
+
+	default:
+		key := replayKey{index, v.Type()}
+		replayed, ok := d.replayed[key]
+		if !ok {
+			if s.offset < d.base {
+				return -1, d.discardedError(offset, v.Type())
+			}
+
+			h := d.hold(offset)
+			replayed = reflect.New(v.Type()).Elem()
+			_, err = d.replay(index).setField(s.offset, replayed)
+			d.release(h)
+			if err != nil {
+				return -1, err
+			}
+
+			d.replayed[key] = replayed
+		}
+
+		v.Set(replayed)
+	}
+
+	if isObjectReference {
+		d.addSlot(s.offset, v)
+	}
+
+	return newOffset, nil
+}
+
+// replay returns a decodeState that can decode the value in slot index again.
+// Decoding the same value always creates the same number of slots, so any
+// references inside of it are resolved the same way the first time around.
+//
+// The replay only sees the slots before index. They are shared with d rather
+// than copied. When decoding from a Decoder the value must not have been
+// discarded, and the caller must hold the data from the reference onwards.
+func (d *decodeState) replay(index int) *decodeState {
+	parent := d
+	for parent.parent != nil && index <= parent.parentSlots {
+		parent = parent.parent
+	}
+
+	path := make([]interface{}, len(d.path))
+	copy(path, d.path)
+
+	return &decodeState{
+		decodeInput: d.decodeInput,
+		parent:      parent,
+		parentSlots: index,
+		registry:    d.registry,
+		path:        path,
+		options:     d.options,
+		depth:       d.depth,
+		replayed:    d.replayed,
+		usage:       d.usage,
+	}
+}
+
+func (d *decodeState) consumeObjectAsMap(offset int) (
+	map[interface{}]interface{}, int, error) {
+	index := d.addSlot(offset, reflect.Value{})
+
+	// Read the class name. The class name follows the same format as a
+	// string. We could just ignore the length and hope that no class name
+	// ever had a non-ascii characters in it, but this is safer - and
+	// probably easier.
+	_, offset, err := d.consumeClassName(offset, 'O', "object")
+	if err != nil {
+		return nil, -1, err
+	}
+
+	return d.consumeMapProperties(index, offset)
+}
+
+// assignValue stores a value that was decoded into interface{} into a value of
+// a concrete type. The offset is where the value started, it is only used for
+// errors.
+func (d *decodeState) assignValue(offset int, structFieldValue reflect.Value,
+	value interface{}) error {
+	if d.options.TypeJuggling {
+		var err error
+		value, err = d.juggle(offset, structFieldValue.Type(), value)
+		if err != nil {
+			return err
+		}
+	}
+
+	val := reflect.ValueOf(value)
+	if !val.IsValid() {
+		// structFieldValue will be set to default.
+		return nil
+	}
+
+	// Values that already have the right type, such as a registered enum case
+	// with an integer type, are stored as they are.
+	if val.Type().AssignableTo(structFieldValue.Type()) {
+		structFieldValue.Set(val)
+		return nil
+	}
+
+	switch structFieldValue.Type().Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		if val.Kind() != reflect.Int64 {
+			return d.typeError(offset, structFieldValue.Type())
+		}
+
+		return d.setInt(offset, structFieldValue, val.Int())
+
+	case reflect.Float32, reflect.Float64:
+		if val.Kind() != reflect.Float64 {
+			return d.typeError(offset, structFieldValue.Type())
+		}
+
+		return d.setFloat(offset, structFieldValue, val.Float())
+
+	default:
+		// Strings can also be decoded into a []byte.
+		if val.Kind() == reflect.String &&
+			structFieldValue.Kind() == reflect.Slice &&
+			structFieldValue.Type().Elem().Kind() == reflect.Uint8 {
+			structFieldValue.SetBytes([]byte(val.String()))
+			return nil
+		}
+
+		return d.typeError(offset, structFieldValue.Type())
+	}
+}
+
+// setInt stores i in v, which must be an integer kind. An
+// *UnmarshalTypeError is returned if i does not fit in v, including negative
+// values for unsigned integers.
+func (d *decodeState) setInt(offset int, v reflect.Value, i int64) error {
+	switch v.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		if i < 0 || v.OverflowUint(uint64(i)) {
+			return d.overflowError(offset, strconv.FormatInt(i, 10), v.Type())
+		}
+
+		v.SetUint(uint64(i))
+
+	default:
+		if v.OverflowInt(i) {
+			return d.overflowError(offset, strconv.FormatInt(i, 10), v.Type())
+		}
+
+		v.SetInt(i)
+	}
+
+	return nil
+}
+
+// setFloat stores f in v, which must be a float kind. An *UnmarshalTypeError is
+// returned if f is too large for a float32. Infinity and NaN can always be
+// stored.
+func (d *decodeState) setFloat(offset int, v reflect.Value, f float64) error {
+	if v.OverflowFloat(f) {
+		return d.overflowError(offset, strconv.FormatFloat(f, 'g', -1, 64),
+			v.Type())
 	}
 
-	s = string(data[offset:newOffset])
-	return
+	v.SetFloat(f)
+
+	return nil
 }
 
-func consumeInt(data []byte, offset int) (int64, int, error) {
-	if !checkType(data, 'i', offset) {
-		return 0, -1, errors.New("not an integer")
+// assignKey stores an array key, which is an int64 or a string, into the key of
+// a map. PHP converts string keys like "123" into integers, so integer keys can
+// also be stored in string keys.
+func (d *decodeState) assignKey(offset int, key reflect.Value,
+	value interface{}) error {
+	if i, ok := value.(int64); ok && key.Kind() == reflect.String {
+		key.SetString(strconv.FormatInt(i, 10))
+		return nil
 	}
 
-	alphaNumber, newOffset := consumeStringUntilByte(data, ';', offset+2)
-	i, err := strconv.Atoi(alphaNumber)
-	if err != nil {
-		return 0, -1, err
+	return d.assignValue(offset, key, value)
+}
+
+// setField consumes the next value and stores it in structFieldValue.
+//
+// Objects, pointers, slices, arrays and maps are decoded directly into the Go
+// value so that references can share them. Everything else is consumed as a
+// generic value first.
+func (d *decodeState) setField(offset int, structFieldValue reflect.Value) (int, error) {
+	d.mark = offset
+	kind := d.byteAt(offset)
+	if kind == 0 {
+		return -1, d.syntaxError(offset, "value")
 	}
 
-	// The +1 is to skip over the final ';'
-	return int64(i), newOffset + 1, nil
-}
+	switch kind {
+	case 'r', 'R':
+		return d.setReference(offset, structFieldValue)
+
+	case 'N':
+		// Like encoding/json, null sets pointers, maps, slices and
+		// interfaces to nil, and leaves any other value as it is, unless it
+		// is able to decode a null itself.
+		if structFieldValue.Kind() == reflect.Ptr ||
+			unmarshaler(structFieldValue) == nil {
+			_, offset, err := d.consumeNext(offset)
+			if err != nil {
+				return -1, err
+			}
+
+			// PHP converts null into the zero value of any type.
+			if isNillable(structFieldValue.Kind()) || d.options.TypeJuggling {
+				structFieldValue.Set(reflect.Zero(structFieldValue.Type()))
+			}
+
+			return offset, nil
+		}
+	}
+
+	if u := unmarshaler(structFieldValue); u != nil {
+		return d.unmarshalWith(offset, u)
+	}
+
+	switch structFieldValue.Kind() {
+	case reflect.Ptr:
+		// Instantiate structFieldValue, unless it already points to a value
+		// that can be decoded into.
+		if structFieldValue.IsNil() {
+			structFieldValue.Set(reflect.New(structFieldValue.Type().Elem()))
+		}
+
+		return d.setField(offset, structFieldValue.Elem())
+
+	case reflect.Interface:
+		// Like encoding/json, an interface that holds a pointer is decoded
+		// into the value that it points to. Otherwise the interface is
+		// replaced with a generic value.
+		if !structFieldValue.IsNil() {
+			elem := structFieldValue.Elem()
+			if elem.Kind() == reflect.Ptr && !elem.IsNil() {
+				return d.setField(offset, elem.Elem())
+			}
+		}
+
+	case reflect.Struct:
+		if kind == 'O' && structFieldValue.Type() == phpObjectType {
+			return d.fillPHPObject(offset, structFieldValue)
+		}
+
+		if kind == 'a' && structFieldValue.Type() == orderedArrayType {
+			return d.fillOrderedArray(offset, structFieldValue)
+		}
+
+		if kind == 'O' || kind == 'a' {
+			return d.fillStruct(offset, structFieldValue)
+		}
+
+	case reflect.Slice:
+		if kind == 'a' &&
+			structFieldValue.Type().Elem().Kind() != reflect.Uint8 {
+			return d.fillSlice(offset, structFieldValue)
+		}
+
+	case reflect.Array:
+		if kind == 'a' {
+			return d.fillSlice(offset, structFieldValue)
+		}
 
-func consumeFloat(data []byte, offset int) (float64, int, error) {
-	if !checkType(data, 'd', offset) {
-		return 0, -1, errors.New("not a float")
+	case reflect.Map:
+		if kind == 'O' || kind == 'a' {
+			return d.fillMap(offset, structFieldValue)
+		}
 	}
 
-	alphaNumber, newOffset := consumeStringUntilByte(data, ';', offset+2)
-	v, err := strconv.ParseFloat(alphaNumber, 64)
+	value, newOffset, err := d.consumeNext(offset)
 	if err != nil {
-		return 0, -1, err
+		return -1, err
 	}
 
-	return v, newOffset + 1, nil
+	return newOffset, d.assignValue(offset, structFieldValue, value)
 }
 
-func consumeString(data []byte, offset int) (string, int, error) {
-	if !checkType(data, 's', offset) {
-		return "", -1, errors.New("not a string")
+// isNillable returns true for the kinds that null is decoded into as nil.
+func isNillable(kind reflect.Kind) bool {
+	switch kind {
+	case reflect.Ptr, reflect.Map, reflect.Slice, reflect.Interface:
+		return true
 	}
 
-	return consumeStringRealPart(data, offset+2)
+	return false
 }
 
-// consumeIntPart will consume an integer followed by and including a colon.
-// This is used in many places to describe the number of elements or an upcoming
-// length.
-func consumeIntPart(data []byte, offset int) (int, int, error) {
-	rawValue, newOffset := consumeStringUntilByte(data, ':', offset)
-	value, err := strconv.Atoi(rawValue)
-	if err != nil {
-		return 0, -1, err
+// unmarshaler returns the Unmarshaler for v, or nil if v does not implement
+// Unmarshaler. Pointers are not checked because they are allocated first.
+func unmarshaler(v reflect.Value) Unmarshaler {
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		return nil
+	}
+
+	if v.CanAddr() && v.Addr().Type().Implements(unmarshalerType) {
+		return v.Addr().Interface().(Unmarshaler)
 	}
 
-	// The +1 is to skip over the ':'
-	return value, newOffset + 1, nil
+	if v.Type().Implements(unmarshalerType) && v.CanInterface() {
+		return v.Interface().(Unmarshaler)
+	}
+
+	return nil
 }
 
-func consumeStringRealPart(data []byte, offset int) (string, int, error) {
-	length, newOffset, err := consumeIntPart(data, offset)
+// unmarshalWith passes the value at offset to an Unmarshaler. The value is also
+// consumed so that the values inside of it are numbered and can be referenced.
+func (d *decodeState) unmarshalWith(offset int, u Unmarshaler) (int, error) {
+	h := d.hold(offset)
+	defer d.release(h)
+
+	_, end, err := d.consumeNext(offset)
 	if err != nil {
-		return "", -1, err
+		return -1, err
 	}
 
-	// Skip over the '"' at the start of the string. I'm not sure why they
-	// decided to wrap the string in double quotes since it's totally
-	// redundant.
-	offset = newOffset + 1
+	return end, u.UnmarshalPHP(d.bytes(offset, end))
+}
 
-	s := DecodePHPString(data[offset : length+offset])
+// fieldByName finds the struct field that a PHP property name or array key
+// should be stored in. The returned value is invalid if there is no field.
+//
+// Protected and private properties only match fields that have the same
+// visibility in their tag. The class name of a private property is ignored.
+func fieldByName(obj reflect.Value, fields []structField, key string) reflect.Value {
+	name, visibility, _ := ParsePropertyName(key)
+
+	for _, field := range fields {
+		if field.name == name && field.options.visibility() == visibility {
+			return settableFieldByIndex(obj, field.index)
+		}
+	}
 
-	// The +2 is to skip over the final '";'
-	return s, offset + length + 2, nil
+	return reflect.Value{}
 }
 
-func consumeNil(data []byte, offset int) (interface{}, int, error) {
-	if !checkType(data, 'N', offset) {
-		return nil, -1, errors.New("not null")
+// fillStruct consumes an object (or associative array) and stores each of the
+// properties in the matching field of obj. Properties that do not have a
+// matching field are consumed and discarded.
+func (d *decodeState) fillStruct(offset int, obj reflect.Value) (int, error) {
+	d.addSlot(offset, obj)
+
+	isObject := d.isType(offset, 'O')
+	offset, err := d.expectByte(offset+1, ':')
+	if err != nil {
+		return -1, err
+	}
+
+	if isObject {
+		// Skip over the class name.
+		_, offset, err = d.consumeStringRealPart(offset, ':')
+		if err != nil {
+			return -1, err
+		}
 	}
 
-	return nil, offset + 2, nil
+	return d.fillFields(offset, obj)
 }
 
-func consumeBool(data []byte, offset int) (bool, int, error) {
-	if !checkType(data, 'b', offset) {
-		return false, -1, errors.New("not a boolean")
+// fillFields consumes the properties of an object (or elements of an array),
+// starting at the number of properties, into the fields of obj.
+func (d *decodeState) fillFields(offset int, obj reflect.Value) (int, error) {
+	length, offset, err := d.consumeCount(offset, 0)
+	if err != nil {
+		return -1, err
 	}
 
-	return data[offset+2] == '1', offset + 4, nil
-}
+	fields := structFields(obj.Type())
+	for i := 0; i < length; i++ {
+		var key interface{}
+		key, offset, err = d.consumeKey(offset)
+		if err != nil {
+			return -1, err
+		}
 
-func consumeObjectAsMap(data []byte, offset int) (
-	map[interface{}]interface{}, int, error) {
-	result := map[interface{}]interface{}{}
+		var field reflect.Value
+		if name, ok := key.(string); ok {
+			field = fieldByName(obj, fields, name)
+		}
 
-	// Read the class name. The class name follows the same format as a
-	// string. We could just ignore the length and hope that no class name
-	// ever had a non-ascii characters in it, but this is safer - and
-	// probably easier.
-	_, offset, err := consumeStringRealPart(data, offset+2)
+		d.pushPath(key)
+		if field.IsValid() {
+			offset, err = d.setField(offset, field)
+		} else {
+			_, offset, err = d.consumeNext(offset)
+		}
+		if err != nil {
+			return -1, err
+		}
+		d.popPath()
+	}
+
+	return d.consumeEnd(offset)
+}
+
+// fillSlice consumes an indexed array into a slice or array of any type.
+// Elements that do not fit in an array are ignored.
+func (d *decodeState) fillSlice(offset int, v reflect.Value) (int, error) {
+	headerOffset, err := d.consumeHeader(offset, 'a', "array")
 	if err != nil {
-		return nil, -1, err
+		return -1, err
 	}
 
-	// Read the number of elements in the object.
-	length, offset, err := consumeIntPart(data, offset)
+	elementSize := v.Type().Elem().Size()
+	length, newOffset, err := d.consumeCount(headerOffset, elementSize)
 	if err != nil {
-		return nil, -1, err
+		return -1, err
 	}
 
-	// Skip over the '{'
-	offset++
+	mode := d.options.SparseArrays
+	switch {
+	case v.Kind() == reflect.Array:
+		v.Set(reflect.Zero(v.Type()))
+
+	case mode == SparseArraysByIndex:
+		// The slice grows as the elements are found.
+		v.Set(reflect.MakeSlice(v.Type(), 0, d.preallocate(newOffset, length)))
+
+	default:
+		n := d.preallocate(newOffset, length)
+		v.Set(reflect.MakeSlice(v.Type(), n, n))
+	}
+	d.addSlot(offset, v)
+	offset = newOffset
 
-	// Read the elements
 	for i := 0; i < length; i++ {
-		var key string
-		var value interface{}
+		var index int64
+		keyOffset := offset
+		if !d.fill(offset + 1) {
+			return -1, d.syntaxError(offset, "integer key")
+		}
 
-		// The key should always be a string. I am not completely sure
-		// about this.
-		key, offset, err = consumeString(data, offset)
+		if !d.isType(offset, 'i') {
+			return -1, d.associativeArrayError(keyOffset, v.Type())
+		}
+
+		index, offset, err = d.consumeInt(offset)
 		if err != nil {
-			return nil, -1, err
+			return -1, err
 		}
 
-		// If the next item is an object we can't simply consume it,
-		// rather we send the reflect.Value back through consumeObject
-		// so the recursion can be handled correctly.
-		if data[offset] == 'O' {
-			var subMap interface{}
+		element := i
+		switch mode {
+		case SparseArraysByOrder:
+			// The key is only used for the path.
+
+		case SparseArraysByIndex:
+			// The index is limited the same way as the count of an
+			// array (see consumeCount), to the elements of the array
+			// and as many more as the rest of the data could hold. A
+			// small amount of data can not create a huge slice, even
+			// with large elements.
+			limit := length
+			if d.dec != nil {
+				// A Decoder has not checked the count, so instead it
+				// reads ahead until the data could hold the elements
+				// up to the index.
+				ahead := index - int64(i)
+				if ahead > 0 && ahead < int64((maxInt-keyOffset)/6) {
+					d.fill(keyOffset + 6*int(ahead+1))
+				}
 
-			subMap, offset, err = consumeObjectAsMap(data, offset)
-			if err != nil {
-				return nil, -1, err
+				limit = i
 			}
 
-			result[key] = subMap
-		} else {
-			value, offset, err = consumeNext(data, offset)
-			if err != nil {
-				return nil, -1, err
+			max := int64(limit + (d.end()-keyOffset)/6)
+			if index < 0 || index >= max {
+				return -1, d.indexError(keyOffset, index, v.Type())
+			}
+
+			element = int(index)
+			if v.Kind() == reflect.Slice {
+				err = d.growSlice(keyOffset, v, element+1)
+				if err != nil {
+					return -1, err
+				}
 			}
 
-			result[key] = value
+		default:
+			if index != int64(i) {
+				return -1, d.associativeArrayError(keyOffset, v.Type())
+			}
+		}
+
+		// A slice from a Decoder grows as its elements are read.
+		if v.Kind() == reflect.Slice && element >= v.Len() {
+			extendSlice(v, element+1)
+		}
+
+		d.pushPath(index)
+		if element < v.Len() {
+			offset, err = d.setField(offset, v.Index(element))
+		} else {
+			_, offset, err = d.consumeNext(offset)
+		}
+		if err != nil {
+			return -1, err
 		}
+		d.popPath()
 	}
 
-	// The +1 is for the final '}'
-	return result, offset + 1, nil
+	return d.consumeEnd(offset)
 }
 
-func setField(structFieldValue reflect.Value, value interface{}) error {
-	if !structFieldValue.IsValid() {
-		return nil
-	}
+// fillMap consumes an array, or the properties of an object, into a map of any
+// type. The elements are added to the map if it already exists.
+func (d *decodeState) fillMap(offset int, v reflect.Value) (int, error) {
+	start := offset
 
-	val := reflect.ValueOf(value)
-	if !val.IsValid() {
-		// structFieldValue will be set to default.
-		return nil
+	var err error
+	if d.isType(offset, 'O') {
+		_, offset, err = d.consumeClassName(offset, 'O', "object")
+	} else {
+		offset, err = d.consumeHeader(offset, 'a', "array")
+	}
+	if err != nil {
+		return -1, err
 	}
 
-	switch structFieldValue.Type().Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		structFieldValue.SetInt(val.Int())
+	length, offset, err := d.consumeCount(offset, mapElementSize)
+	if err != nil {
+		return -1, err
+	}
 
-	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		structFieldValue.SetUint(val.Uint())
+	if v.IsNil() {
+		v.Set(reflect.MakeMap(v.Type()))
+	}
+	d.addSlot(start, v)
 
-	case reflect.Float32, reflect.Float64:
-		structFieldValue.SetFloat(val.Float())
+	for i := 0; i < length; i++ {
+		var key interface{}
 
-	case reflect.Struct:
-		m := val.Interface().(map[interface{}]interface{})
-		fillStruct(structFieldValue, m)
+		keyOffset := offset
+		key, offset, err = d.consumeKey(offset)
+		if err != nil {
+			return -1, err
+		}
 
-	case reflect.Slice:
-		l := val.Len()
-		arrayOfObjects := reflect.MakeSlice(structFieldValue.Type(), l, l)
-
-		for i := 0; i < l; i++ {
-			if m, ok := val.Index(i).Interface().(map[interface{}]interface{}); ok {
-				obj := arrayOfObjects.Index(i)
-				fillStruct(obj, m)
-			} else {
-				switch arrayOfObjects.Index(i).Kind() {
-				case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-					arrayOfObjects.Index(i).SetInt(val.Index(i).Elem().Int())
-				case reflect.Float32, reflect.Float64:
-					arrayOfObjects.Index(i).SetFloat(val.Index(i).Elem().Float())
-				default:
-					arrayOfObjects.Index(i).Set(val.Index(i).Elem())
-				}
+		mapKey := reflect.New(v.Type().Key()).Elem()
+		err = d.assignKey(keyOffset, mapKey, key)
+		if err != nil {
+			return -1, err
+		}
 
-			}
+		d.pushPath(key)
+		element := reflect.New(v.Type().Elem()).Elem()
+		offset, err = d.setField(offset, element)
+		if err != nil {
+			return -1, err
 		}
+		d.popPath()
 
-		structFieldValue.Set(arrayOfObjects)
-	case reflect.Ptr:
-		// Instantiate structFieldValue.
-		structFieldValue.Set(reflect.New(structFieldValue.Type().Elem()))
-		return setField(structFieldValue.Elem(), value)
-	default:
-		structFieldValue.Set(val)
+		v.SetMapIndex(mapKey, element)
 	}
 
-	return nil
+	return d.consumeEnd(offset)
 }
 
-// https://stackoverflow.com/questions/26744873/converting-map-to-struct
-func fillStruct(obj reflect.Value, m map[interface{}]interface{}) error {
-	tt := obj.Type()
-	for i := 0; i < obj.NumField(); i++ {
-		field := obj.Field(i)
-		if !field.CanSet() {
-			continue
-		}
-		var key string
-		if tag := tt.Field(i).Tag.Get("php"); tag == "-" {
-			continue
-		} else if tag != "" {
-			key = tag
-		} else {
-			key = lowerCaseFirstLetter(tt.Field(i).Name)
-		}
-		if v, ok := m[key]; ok {
-			setField(field, v)
+// growSlice makes the slice v at least length long. The new elements are zero
+// values.
+func (d *decodeState) growSlice(offset int, v reflect.Value, length int) error {
+	if length <= v.Len() {
+		return nil
+	}
+
+	if length > v.Cap() {
+		err := d.allocate(offset, (grownCap(v.Cap(), length)-v.Cap())*
+			int(v.Type().Elem().Size()))
+		if err != nil {
+			return err
 		}
 	}
 
+	extendSlice(v, length)
+
 	return nil
 }
 
-func consumeObject(data []byte, offset int, v reflect.Value) (int, error) {
-	if !checkType(data, 'O', offset) {
-		return -1, errors.New("not an object")
+// extendSlice is the same as growSlice, for memory that has already been
+// allocated by consumeCount.
+func extendSlice(v reflect.Value, length int) {
+	if length <= v.Len() {
+		return
 	}
 
-	m, offset, err := consumeObjectAsMap(data, offset)
-	if err != nil {
-		return -1, err
+	if length > v.Cap() {
+		grown := reflect.MakeSlice(v.Type(), v.Len(), grownCap(v.Cap(), length))
+		reflect.Copy(grown, v)
+		v.Set(grown)
+	}
+
+	v.SetLen(length)
+}
+
+// grownCap is the capacity that a slice grows to from capacity, so that it can
+// hold at least length elements.
+func grownCap(capacity, length int) int {
+	if capacity*2 < length {
+		return length
+	}
+
+	return capacity * 2
+}
+
+func (d *decodeState) consumeObject(offset int, v reflect.Value) (int, error) {
+	if !d.isType(offset, 'O') {
+		return -1, d.syntaxError(offset, "object")
+	}
+
+	if v.Kind() != reflect.Struct || !v.CanSet() {
+		return -1, d.typeError(offset, v.Type())
+	}
+
+	if v.Type() == phpObjectType {
+		return d.fillPHPObject(offset, v)
 	}
 
-	return offset, fillStruct(v, m)
+	return d.fillStruct(offset, v)
 }
 
-func consumeNext(data []byte, offset int) (interface{}, int, error) {
-	if offset >= len(data) {
-		return nil, -1, errors.New("corrupt")
+// consumeNext consumes any value. Each value that is consumed is numbered so
+// that it can be referenced later.
+func (d *decodeState) consumeNext(offset int) (interface{}, int, error) {
+	d.mark = offset
+	kind := d.byteAt(offset)
+
+	value, newOffset, err := d.consumeValue(offset, kind)
+	if err != nil {
+		return nil, -1, err
 	}
 
-	switch data[offset] {
+	d.lastOffset, d.lastKind = offset, kind
+
+	return value, newOffset, nil
+}
+
+// consumeValue is consumeNext for a value of the type kind.
+func (d *decodeState) consumeValue(offset int, kind byte) (interface{}, int, error) {
+	var value interface{}
+	var newOffset int
+	var err error
+
+	switch kind {
 	case 'a':
-		return consumeIndexedOrAssociativeArray(data, offset)
+		return d.consumeArray(offset)
+	case 'O':
+		return d.consumeGenericObject(offset)
+	case 'C':
+		return d.consumeCustomObject(offset)
+	case 'r', 'R':
+		return d.consumeReference(offset)
 	case 'b':
-		return consumeBool(data, offset)
+		value, newOffset, err = d.consumeBool(offset)
 	case 'd':
-		return consumeFloat(data, offset)
+		value, newOffset, err = d.consumeFloat(offset)
 	case 'i':
-		return consumeInt(data, offset)
+		value, newOffset, err = d.consumeInt(offset)
 	case 's':
-		return consumeString(data, offset)
+		value, newOffset, err = d.consumeString(offset)
+	case 'E':
+		value, newOffset, err = d.consumeEnum(offset)
 	case 'N':
-		return consumeNil(data, offset)
-	case 'O':
-		return consumeObjectAsMap(data, offset)
+		value, newOffset, err = d.consumeNil(offset)
+	default:
+		return nil, -1, d.syntaxError(offset, "value")
+	}
+
+	if err != nil {
+		return nil, -1, err
 	}
 
-	return nil, -1, errors.New("can not consume type: " +
-		string(data[offset:]))
+	d.addGenericSlot(offset, value)
+
+	return value, newOffset, nil
 }
 
-func consumeIndexedOrAssociativeArray(data []byte, offset int) (interface{}, int, error) {
-	// Sometimes we don't know if the array is going to be indexed or
-	// associative until we have already started to consume it.
-	originalOffset := offset
+// consumeArray consumes an array when there is no Go type to guide it. A list
+// (with the keys 0, 1, 2, etc) is decoded as a []interface{} and any other array
+// as a map, or an *OrderedArray when the OrderedArrays option is enabled.
+//
+// We don't know if the array is a list until all of the keys have been read,
+// so the elements are moved out of the list as soon as a key does not fit.
+func (d *decodeState) consumeArray(offset int) (interface{}, int, error) {
+	headerOffset, err := d.consumeHeader(offset, 'a', "array")
+	if err != nil {
+		return nil, -1, err
+	}
+
+	index := d.addSlot(offset, reflect.Value{})
+
+	length, offset, err := d.consumeCount(headerOffset, interfaceType.Size())
+	if err != nil {
+		return nil, -1, err
+	}
+
+	list := make([]interface{}, d.preallocate(offset, length))
+	d.slot(index).value = genericValue(list)
+
+	var result interface{} = list
+	var add func(key, value interface{})
+
+	for i := 0; i < length; i++ {
+		var key, value interface{}
+
+		keyOffset := offset
+		key, offset, err = d.consumeKey(offset)
+		if err != nil {
+			return nil, -1, err
+		}
+
+		// A list from a Decoder grows as its elements are read.
+		if add == nil && i == len(list) {
+			list = append(list, nil)
+			result = list
+			d.slot(index).value = genericValue(list)
+		}
+
+		if add == nil && key != int64(i) {
+			result, add, err = d.associativeArray(index, keyOffset, list[:i],
+				length)
+			if err != nil {
+				return nil, -1, err
+			}
+		}
+
+		d.pushPath(key)
+		value, offset, err = d.consumeNext(offset)
+		if err != nil {
+			return nil, -1, err
+		}
+		d.popPath()
+
+		if add == nil {
+			list[i] = value
+		} else {
+			add(key, value)
+		}
+	}
 
-	// Try to consume it as an indexed array first.
-	arr, offset, err := consumeIndexedArray(data, originalOffset)
-	if err == nil {
-		return arr, offset, err
+	offset, err = d.consumeEnd(offset)
+	if err != nil {
+		return nil, -1, err
 	}
 
-	// Fallback to consuming an associative array
-	return consumeAssociativeArray(data, originalOffset)
+	return result, offset, nil
 }
 
-func consumeAssociativeArray(data []byte, offset int) (map[interface{}]interface{}, int, error) {
-	if !checkType(data, 'a', offset) {
-		return map[interface{}]interface{}{}, -1, errors.New("not an array")
+// associativeArray replaces the list in the slot at index with a map (or an
+// *OrderedArray) that contains the elements of the list so far. It returns the
+// new array and a function that adds the rest of the elements to it.
+func (d *decodeState) associativeArray(index, offset int, list []interface{},
+	length int) (interface{}, func(key, value interface{}), error) {
+	err := d.allocate(offset, length*(mapElementSize-int(interfaceType.Size())))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	capacity := len(list) + d.preallocate(offset, length-len(list))
+
+	if d.options.OrderedArrays {
+		result := &OrderedArray{Elements: make([]ArrayElement, len(list), capacity)}
+		for i, value := range list {
+			result.Elements[i] = ArrayElement{int64(i), value}
+		}
+		d.slot(index).value = genericValue(result)
+
+		return result, func(key, value interface{}) {
+			result.Elements = append(result.Elements, ArrayElement{key, value})
+		}, nil
+	}
+
+	result := make(map[interface{}]interface{}, capacity)
+	for i, value := range list {
+		result[int64(i)] = value
 	}
+	d.slot(index).value = genericValue(result)
 
-	// Skip over the "a:"
-	offset += 2
+	return result, func(key, value interface{}) {
+		result[key] = value
+	}, nil
+}
 
-	rawLength, offset := consumeStringUntilByte(data, ':', offset)
-	length, err := strconv.Atoi(rawLength)
+func (d *decodeState) consumeAssociativeArray(offset int) (map[interface{}]interface{}, int, error) {
+	headerOffset, err := d.consumeHeader(offset, 'a', "array")
 	if err != nil {
 		return map[interface{}]interface{}{}, -1, err
 	}
 
-	// Skip over the ":{"
-	offset += 2
-
 	result := map[interface{}]interface{}{}
+	d.addGenericSlot(offset, result)
+
+	length, offset, err := d.consumeCount(headerOffset, mapElementSize)
+	if err != nil {
+		return map[interface{}]interface{}{}, -1, err
+	}
+
 	for i := 0; i < length; i++ {
 		var key interface{}
 
-		key, offset, err = consumeNext(data, offset)
+		key, offset, err = d.consumeKey(offset)
 		if err != nil {
 			return map[interface{}]interface{}{}, -1, err
 		}
 
-		result[key], offset, err = consumeNext(data, offset)
+		d.pushPath(key)
+		result[key], offset, err = d.consumeNext(offset)
 		if err != nil {
 			return map[interface{}]interface{}{}, -1, err
 		}
+		d.popPath()
 	}
 
-	return result, offset + 1, nil
+	offset, err = d.consumeEnd(offset)
+	if err != nil {
+		return map[interface{}]interface{}{}, -1, err
+	}
+
+	return result, offset, nil
 }
 
-func consumeIndexedArray(data []byte, offset int) ([]interface{}, int, error) {
-	if !checkType(data, 'a', offset) {
-		return []interface{}{}, -1, errors.New("not an array")
+func (d *decodeState) consumeIndexedArray(offset int) ([]interface{}, int, error) {
+	headerOffset, err := d.consumeHeader(offset, 'a', "array")
+	if err != nil {
+		return []interface{}{}, -1, err
 	}
 
-	rawLength, offset := consumeStringUntilByte(data, ':', offset+2)
-	length, err := strconv.Atoi(rawLength)
+	index := d.addSlot(offset, reflect.Value{})
+
+	length, offset, err := d.consumeCount(headerOffset, interfaceType.Size())
 	if err != nil {
 		return []interface{}{}, -1, err
 	}
 
-	// Skip over the ":{"
-	offset += 2
+	result := make([]interface{}, d.preallocate(offset, length))
+	d.slot(index).value = genericValue(result)
 
-	result := make([]interface{}, length)
 	for i := 0; i < length; i++ {
+		// A list from a Decoder grows as its elements are read.
+		if i == len(result) {
+			result = append(result, nil)
+			d.slot(index).value = genericValue(result)
+		}
+
 		// Even non-associative arrays (arrays that are zero-indexed)
 		// still have their keys serialized. We need to read these
 		// indexes to make sure we are actually decoding a slice and not
 		// a map.
 		var index int64
-		index, offset, err = consumeInt(data, offset)
+		keyOffset := offset
+		if !d.isType(offset, 'i') {
+			return []interface{}{}, -1,
+				d.associativeArrayError(keyOffset, reflect.TypeOf(result))
+		}
+
+		index, offset, err = d.consumeInt(offset)
 		if err != nil {
 			return []interface{}{}, -1, err
 		}
 
 		if index != int64(i) {
 			return []interface{}{}, -1,
-				errors.New("cannot decode map as slice")
+				d.associativeArrayError(keyOffset, reflect.TypeOf(result))
 		}
 
 		// Now we consume the value
-		result[i], offset, err = consumeNext(data, offset)
+		d.pushPath(index)
+		result[i], offset, err = d.consumeNext(offset)
 		if err != nil {
 			return []interface{}{}, -1, err
 		}
+		d.popPath()
+	}
+
+	offset, err = d.consumeEnd(offset)
+	if err != nil {
+		return []interface{}{}, -1, err
 	}
 
-	// The +1 is for the final '}'
-	return result, offset + 1, nil
+	return result, offset, nil
 }
@@ -0,0 +1,236 @@
+package phpserialize
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+)
+
+// CustomSerializer is implemented by types that encode themselves as a PHP
+// custom serialized object. This is the "C:" format that PHP uses for classes
+// that implement the Serializable interface:
+//
+//	C:11:"ArrayObject":21:{x:i:0;a:0:{};m:a:0:{}}
+//
+// SerializePHP returns the PHP class name and the payload, which is the
+// equivalent of the return value of the serialize() method of the PHP class.
+// Values in the payload should be encoded with enc, see PayloadEncoder.
+type CustomSerializer interface {
+	SerializePHP(enc *PayloadEncoder) (className string, payload []byte,
+		err error)
+}
+
+// PayloadEncoder encodes values for the payload of a custom serialized object.
+//
+// When the serialize() method of a PHP class calls serialize() itself, the
+// values are numbered along with all of the values around the object. This
+// means that references inside of the payload can refer to values outside of
+// it, and the other way around. Values encoded with a PayloadEncoder are
+// numbered the same way. They must be put in the payload in the order that
+// they were encoded.
+//
+// A PayloadEncoder can only be used until SerializePHP returns.
+type PayloadEncoder struct {
+	e *encodeState
+}
+
+// Encode returns the serialized value of v. See Marshal.
+func (p *PayloadEncoder) Encode(v interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+
+	w := p.e.w
+	p.e.w = &buffer
+	err := p.e.marshal(v)
+	p.e.w = w
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// PHPCustomObject is a custom serialized object that does not have a decoder
+// registered for its class. The payload is kept as is so that the value will
+// be encoded exactly the same way by Marshal.
+type PHPCustomObject struct {
+	ClassName string
+	Payload   []byte
+}
+
+// SerializePHP implements CustomSerializer.
+func (o PHPCustomObject) SerializePHP(*PayloadEncoder) (string, []byte, error) {
+	return o.ClassName, o.Payload, nil
+}
+
+// MarshalCustom returns the bytes to represent a PHP custom serialized object.
+// This would be the equivalent to running:
+//
+//	echo serialize(new ArrayObject());
+//	// C:11:"ArrayObject":21:{x:i:0;a:0:{};m:a:0:{}}
+//
+// The same result would be returned by marshalling a value that implements
+// CustomSerializer.
+func MarshalCustom(className string, payload []byte) []byte {
+	return []byte(fmt.Sprintf("C:%d:\"%s\":%d:{%s}", len(className),
+		className, len(payload), payload))
+}
+
+func (e *encodeState) marshalCustom(c CustomSerializer) error {
+	className, payload, err := c.SerializePHP(&PayloadEncoder{e})
+	if err != nil {
+		return err
+	}
+
+	e.w.Write(MarshalCustom(className, payload))
+
+	return nil
+}
+
+// consumeCustomObject consumes a "C:" record. If there is a decoder registered
+// for the class (and the class is allowed) it will be used to decode the
+// payload, otherwise a *PHPCustomObject is returned.
+//
+// Values inside of the payload are only numbered when the decoder uses the
+// PayloadDecoder, otherwise the payload is opaque.
+func (d *decodeState) consumeCustomObject(offset int) (interface{}, int, error) {
+	index := d.addSlot(offset, reflect.Value{})
+
+	start := offset
+	className, offset, err := d.consumeClassName(offset, 'C', "custom object")
+	if err != nil {
+		return nil, -1, err
+	}
+
+	allowed := d.classAllowed(className)
+	if !allowed && d.options.RejectDisallowedClasses {
+		return nil, -1, d.disallowedClassError(start, className)
+	}
+
+	lengthOffset := offset
+	length, offset, err := d.consumeIntPart(offset)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	offset, err = d.expectByte(offset, '{')
+	if err != nil {
+		return nil, -1, err
+	}
+
+	// The length is checked before it is added to the offset so that a huge
+	// length can not overflow.
+	if length < 0 {
+		return nil, -1, d.numberError(lengthOffset, "length",
+			strconv.Itoa(length))
+	}
+
+	if err := d.allocateString(lengthOffset, length); err != nil {
+		return nil, -1, err
+	}
+
+	if length >= maxInt-offset || !d.fill(offset+length+1) {
+		return nil, -1, d.syntaxError(d.end(), `"}"`)
+	}
+
+	if _, err := d.expectByte(offset+length, '}'); err != nil {
+		return nil, -1, err
+	}
+
+	payload := d.bytes(offset, offset+length)
+
+	// The payload of a class that is not allowed is kept as it is. It is
+	// never given to the decoder that is registered for the class.
+	var value interface{}
+	if fn := d.registry.customFunc(className); fn != nil && allowed {
+		// The payload is counted as another level so that a reference to
+		// the object from inside of its own payload can not recurse
+		// forever.
+		d.depth++
+		if max := d.options.MaxDepth; max > 0 && d.depth > max {
+			return nil, -1, d.limitError(start, "MaxDepth", max)
+		}
+
+		h := d.hold(offset)
+		value, err = fn(payload, &PayloadDecoder{d, offset, offset, offset + length})
+		d.release(h)
+		if err != nil {
+			return nil, -1, err
+		}
+
+		d.depth--
+	} else {
+		value = &PHPCustomObject{
+			ClassName: className,
+			Payload:   append([]byte{}, payload...),
+		}
+	}
+
+	d.slot(index).value = genericValue(value)
+
+	// The +1 is for the final '}'
+	return value, offset + length + 1, nil
+}
+
+// PayloadDecoder decodes the serialized values inside of the payload of a
+// custom serialized object.
+//
+// When the unserialize() method of a PHP class calls unserialize() itself, the
+// values are numbered along with all of the values around the object. So any
+// reference after the object counts the values inside of its payload, and
+// references inside of the payload can refer to values outside of it. Values
+// decoded with a PayloadDecoder are numbered the same way. Values that are
+// decoded any other way, such as with Unmarshal, are not numbered.
+//
+// A PayloadDecoder can only be used until the CustomUnserializeFunc returns.
+type PayloadDecoder struct {
+	d *decodeState
+
+	// start is the first byte of the payload, offset is the next byte to
+	// be read and end is the '}' after the payload.
+	start, offset, end int
+}
+
+// Offset returns how much of the payload has been read.
+func (p *PayloadDecoder) Offset() int {
+	return p.offset - p.start
+}
+
+// Skip moves past the next n bytes of the payload, which are not a serialized
+// value. For example, the "x:" at the start of the payload of an ArrayObject.
+func (p *PayloadDecoder) Skip(n int) error {
+	if n < 0 || n > p.end-p.offset {
+		return p.d.syntaxError(p.end, strconv.Itoa(n)+" more bytes")
+	}
+
+	p.offset += n
+
+	return nil
+}
+
+// Decode decodes the serialized value at the current offset of the payload
+// into the value pointed to by v, and moves past it. See Unmarshal.
+func (p *PayloadDecoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+
+	if p.offset >= p.end {
+		return p.d.syntaxError(p.offset, "value")
+	}
+
+	offset, err := p.d.setField(p.offset, rv.Elem())
+	if err != nil {
+		return err
+	}
+
+	if offset > p.end {
+		return p.d.syntaxError(p.end, "end of value")
+	}
+
+	p.offset = offset
+
+	return nil
+}
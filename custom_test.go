@@ -0,0 +1,294 @@
+package phpserialize_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/elliotchance/phpserialize"
+)
+
+// arrayObject is a minimal decoding of PHP's ArrayObject. Its payload looks
+// like "x:i:0;a:1:{...};m:a:0:{}".
+type arrayObject struct {
+	Flags   int64
+	Storage map[interface{}]interface{}
+}
+
+func (a *arrayObject) SerializePHP(enc *phpserialize.PayloadEncoder) (
+	string, []byte, error) {
+	flags, err := enc.Encode(a.Flags)
+	if err != nil {
+		return "", nil, err
+	}
+
+	storage, err := enc.Encode(a.Storage)
+	if err != nil {
+		return "", nil, err
+	}
+
+	members, err := enc.Encode(map[string]interface{}{})
+	if err != nil {
+		return "", nil, err
+	}
+
+	payload := "x:" + string(flags) + string(storage) + ";m:" + string(members)
+
+	return "ArrayObject", []byte(payload), nil
+}
+
+func decodeArrayObject(payload []byte,
+	dec *phpserialize.PayloadDecoder) (interface{}, error) {
+	if !bytes.HasPrefix(payload, []byte("x:")) {
+		return nil, errors.New("bad ArrayObject")
+	}
+
+	result := &arrayObject{}
+	err := dec.Skip(2)
+	if err == nil {
+		err = dec.Decode(&result.Flags)
+	}
+	if err == nil {
+		err = dec.Decode(&result.Storage)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(payload[dec.Offset():], []byte(";m:")) {
+		return nil, errors.New("bad ArrayObject")
+	}
+
+	var members map[interface{}]interface{}
+	err = dec.Skip(3)
+	if err == nil {
+		err = dec.Decode(&members)
+	}
+
+	return result, err
+}
+
+func newArrayObjectOptions() *phpserialize.DecodeOptions {
+	options := phpserialize.DefaultDecodeOptions()
+	options.Registry = phpserialize.NewRegistry()
+	options.Registry.RegisterCustom("ArrayObject", decodeArrayObject)
+
+	return options
+}
+
+func TestUnmarshalCustomObject(t *testing.T) {
+	data := `a:2:{i:0;C:11:"ArrayObject":33:{x:i:0;a:1:{s:1:"a";i:1;};m:a:0:{}}i:1;r:2;}`
+	var result []interface{}
+	err := phpserialize.UnmarshalWithOptions([]byte(data), &result,
+		newArrayObjectOptions())
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := &arrayObject{
+		Storage: map[interface{}]interface{}{"a": int64(1)},
+	}
+
+	if !reflect.DeepEqual(result[0], expected) {
+		t.Errorf("Expected:\n  %#+v\nGot:\n  %#+v", expected, result[0])
+	}
+
+	if result[0] != result[1] {
+		t.Errorf("Expected the reference to be the same object")
+	}
+}
+
+func TestUnmarshalCustomObjectIsCaseInsensitive(t *testing.T) {
+	data := `C:12:"\arrayobject":21:{x:i:0;a:0:{};m:a:0:{}}`
+	var result []interface{}
+	err := phpserialize.UnmarshalWithOptions([]byte("a:1:{i:0;"+data+"}"),
+		&result, newArrayObjectOptions())
+	expectErrorToNotHaveOccurred(t, err)
+
+	if _, ok := result[0].(*arrayObject); !ok {
+		t.Errorf("Expected *arrayObject, got %#+v", result[0])
+	}
+}
+
+// version is decoded from a custom object with a payload like "1.2".
+type version struct {
+	Major, Minor int
+}
+
+type release struct {
+	Version version
+}
+
+func decodeVersion(payload []byte,
+	_ *phpserialize.PayloadDecoder) (interface{}, error) {
+	var v version
+	_, err := fmt.Sscanf(string(payload), "%d.%d", &v.Major, &v.Minor)
+
+	return v, err
+}
+
+func TestUnmarshalCustomObjectIntoStruct(t *testing.T) {
+	options := phpserialize.DefaultDecodeOptions()
+	options.Registry = phpserialize.NewRegistry()
+	options.Registry.RegisterCustom("Version", decodeVersion)
+
+	data := `C:7:"Version":3:{1.2}`
+
+	var result version
+	err := phpserialize.UnmarshalWithOptions([]byte(data), &result, options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if result != (version{1, 2}) {
+		t.Errorf("Expected version 1.2, got %#+v", result)
+	}
+
+	var r release
+	err = phpserialize.UnmarshalWithOptions(
+		[]byte(`O:7:"release":1:{s:7:"version";`+data+`}`), &r, options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if r.Version != (version{1, 2}) {
+		t.Errorf("Expected version 1.2, got %#+v", r.Version)
+	}
+}
+
+func TestUnmarshalUnregisteredCustomObject(t *testing.T) {
+	data := `a:1:{i:0;C:10:"SplUnknown":6:{i:123;}}`
+	var result []interface{}
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := &phpserialize.PHPCustomObject{
+		ClassName: "SplUnknown",
+		Payload:   []byte("i:123;"),
+	}
+
+	if !reflect.DeepEqual(result[0], expected) {
+		t.Errorf("Expected:\n  %#+v\nGot:\n  %#+v", expected, result[0])
+	}
+
+	// It must encode back to exactly the same value.
+	out, err := phpserialize.Marshal(result, nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if string(out) != data {
+		t.Errorf("Expected %s, got %s", data, out)
+	}
+}
+
+func TestUnmarshalCorruptCustomObject(t *testing.T) {
+	data := `a:1:{i:0;C:10:"SplUnknown":60:{i:123;}}`
+	var result []interface{}
+	err := phpserialize.Unmarshal([]byte(data), &result)
+
+	expectErrorToEqual(t, err, errors.New(`syntax error at offset 39 ($[0]): expected "}", found end of data`))
+}
+
+func TestMarshalCustomObject(t *testing.T) {
+	input := &arrayObject{
+		Storage: map[interface{}]interface{}{"a": 1},
+	}
+
+	result, err := phpserialize.Marshal(map[string]interface{}{
+		"x": input,
+		"y": input,
+	}, getReferences())
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := `a:2:{s:1:"x";C:11:"ArrayObject":33:{x:i:0;a:1:{s:1:"a";i:1;};m:a:0:{}}s:1:"y";r:2;}`
+	if string(result) != expected {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+}
+
+func TestMarshalCustom(t *testing.T) {
+	result := phpserialize.MarshalCustom("Foo", []byte("bar"))
+	expected := `C:3:"Foo":3:{bar}`
+
+	if string(result) != expected {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+}
+
+// foo is a custom object with a payload that is a single serialized value,
+// like a PHP class that returns serialize($this->items) from serialize().
+type foo struct {
+	Items interface{}
+}
+
+func (f *foo) SerializePHP(enc *phpserialize.PayloadEncoder) (
+	string, []byte, error) {
+	payload, err := enc.Encode(f.Items)
+
+	return "Foo", payload, err
+}
+
+func decodeFoo(payload []byte,
+	dec *phpserialize.PayloadDecoder) (interface{}, error) {
+	result := &foo{}
+	err := dec.Decode(&result.Items)
+
+	return result, err
+}
+
+func newFooOptions() *phpserialize.DecodeOptions {
+	options := phpserialize.DefaultDecodeOptions()
+	options.Registry = phpserialize.NewRegistry()
+	options.Registry.RegisterCustom("Foo", decodeFoo)
+
+	return options
+}
+
+type emptyObject struct{}
+
+func TestUnmarshalCustomObjectPayloadIsNumbered(t *testing.T) {
+	// The values in the payload of Foo are numbered 3 and 4, so the
+	// object is 5.
+	data := `a:4:{i:0;C:3:"Foo":14:{a:1:{i:0;i:1;}}` +
+		`i:1;O:8:"stdClass":0:{}i:2;r:5;i:3;C:3:"Foo":4:{r:5;}}`
+
+	var result []interface{}
+	err := phpserialize.UnmarshalWithOptions([]byte(data), &result,
+		newFooOptions())
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := &foo{Items: []interface{}{int64(1)}}
+	if !reflect.DeepEqual(result[0], expected) {
+		t.Errorf("Expected %#+v, got %#+v", expected, result[0])
+	}
+
+	object := result[1].(map[interface{}]interface{})
+	if reflect.ValueOf(result[2]).Pointer() != reflect.ValueOf(object).Pointer() {
+		t.Errorf("Expected the object, got %#+v", result[2])
+	}
+
+	// A reference inside of a payload can refer to a value outside of it.
+	items := result[3].(*foo).Items
+	if reflect.ValueOf(items).Pointer() != reflect.ValueOf(object).Pointer() {
+		t.Errorf("Expected the object, got %#+v", items)
+	}
+}
+
+func TestUnmarshalCustomObjectReferencesItself(t *testing.T) {
+	var result interface{}
+	err := phpserialize.UnmarshalWithOptions([]byte(`C:3:"Foo":4:{r:1;}`),
+		&result, newFooOptions())
+
+	expectErrorToEqual(t, err,
+		errors.New("exceeded MaxDepth of 4096 at offset 0 ($)"))
+}
+
+func TestMarshalCustomObjectPayloadIsNumbered(t *testing.T) {
+	object := &emptyObject{}
+	input := []interface{}{&foo{Items: []int{1}}, object, object,
+		&foo{Items: object}}
+
+	result, err := phpserialize.Marshal(input, getReferences())
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := `a:4:{i:0;C:3:"Foo":14:{a:1:{i:0;i:1;}}` +
+		`i:1;O:11:"emptyObject":0:{}i:2;r:5;i:3;C:3:"Foo":4:{r:5;}}`
+	if string(result) != expected {
+		t.Errorf("Expected %s, got %s", expected, result)
+	}
+}
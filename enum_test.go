@@ -0,0 +1,187 @@
+package phpserialize_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/elliotchance/phpserialize"
+)
+
+type suit string
+
+const (
+	hearts suit = "Hearts"
+	spades suit = "Spades"
+)
+
+func (s suit) PHPEnumCase() (string, string) {
+	return "App\\Suit", string(s)
+}
+
+func newSuitRegistry() *phpserialize.Registry {
+	registry := phpserialize.NewRegistry()
+	registry.RegisterEnum(hearts, spades)
+
+	return registry
+}
+
+type card struct {
+	Suit  suit
+	Value int
+}
+
+func TestUnmarshalEnum(t *testing.T) {
+	data := `a:2:{i:0;E:13:"Status:Active";i:1;r:2;}`
+
+	var result []interface{}
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	active := phpserialize.PHPEnum{ClassName: "Status", Case: "Active"}
+	expected := []interface{}{active, active}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %#+v, got %#+v", expected, result)
+	}
+}
+
+func TestUnmarshalRegisteredEnum(t *testing.T) {
+	data := `a:2:{i:0;E:15:"app\suit:Spades";` +
+		`i:1;O:4:"card":2:{s:4:"suit";E:15:"App\Suit:Hearts";s:5:"value";i:10;}}`
+
+	options := phpserialize.DefaultDecodeOptions()
+	options.Registry = newSuitRegistry()
+
+	var result []interface{}
+	err := phpserialize.UnmarshalWithOptions([]byte(data), &result, options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if result[0] != spades {
+		t.Errorf("Expected spades, got %#+v", result[0])
+	}
+
+	var c card
+	err = phpserialize.UnmarshalWithOptions([]byte(data[36:len(data)-1]), &c,
+		options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if c != (card{hearts, 10}) {
+		t.Errorf("Expected hearts, got %#+v", c)
+	}
+}
+
+func TestUnmarshalEnumErrors(t *testing.T) {
+	tests := map[string]struct {
+		input         string
+		expectedError error
+	}{
+		"UnknownCase": {
+			`E:14:"App\Suit:Clubs";`,
+			errors.New("can not unmarshal enum case App\\Suit::Clubs into Go " +
+				"value of type phpserialize_test.suit at offset 0 ($)"),
+		},
+		"MissingCase": {
+			`E:9:"App\Suit:";`,
+			errors.New(`syntax error at offset 0 ($): expected "Class:Case", ` +
+				`found "App\\Suit:"`),
+		},
+		"NotRegistered": {
+			`E:13:"Status:Active";`,
+			errors.New("can not unmarshal enum into Go value of type " +
+				"phpserialize_test.suit at offset 0 ($)"),
+		},
+	}
+
+	options := phpserialize.DefaultDecodeOptions()
+	options.Registry = newSuitRegistry()
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var result suit
+			err := phpserialize.UnmarshalWithOptions([]byte(test.input),
+				&result, options)
+			expectErrorToEqual(t, err, test.expectedError)
+		})
+	}
+}
+
+func TestMarshalEnum(t *testing.T) {
+	input := []interface{}{
+		card{hearts, 10},
+		phpserialize.PHPEnum{ClassName: "Status", Case: "Active"},
+	}
+
+	result, err := phpserialize.Marshal(input, nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := `a:2:{i:0;O:4:"card":2:{s:4:"suit";E:15:"App\Suit:Hearts";` +
+		`s:5:"value";i:10;}i:1;E:13:"Status:Active";}`
+	if string(result) != expected {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+}
+
+func TestDecoderEnum(t *testing.T) {
+	dec := phpserialize.NewDecoder(bytes.NewReader(
+		[]byte(`E:13:"Status:Active";i:1;`)))
+
+	var result interface{}
+	err := dec.Decode(&result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := phpserialize.PHPEnum{ClassName: "Status", Case: "Active"}
+	if result != expected {
+		t.Errorf("Expected %#+v, got %#+v", expected, result)
+	}
+}
+
+type status int
+
+const (
+	inactive status = iota
+	active
+)
+
+func (s status) PHPEnumCase() (string, string) {
+	if s == active {
+		return "Status", "Active"
+	}
+
+	return "Status", "Inactive"
+}
+
+type account struct {
+	Status status
+}
+
+func TestUnmarshalRegisteredIntEnum(t *testing.T) {
+	options := phpserialize.DefaultDecodeOptions()
+	options.Registry = phpserialize.NewRegistry()
+	options.Registry.RegisterEnum(active, inactive)
+
+	var result status
+	err := phpserialize.UnmarshalWithOptions([]byte(`E:13:"Status:Active";`),
+		&result, options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if result != active {
+		t.Errorf("Expected active, got %#+v", result)
+	}
+
+	var a account
+	err = phpserialize.UnmarshalWithOptions(
+		[]byte(`O:7:"account":1:{s:6:"status";E:15:"Status:Inactive";}`),
+		&a, options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if a.Status != inactive {
+		t.Errorf("Expected inactive, got %#+v", a.Status)
+	}
+
+	result = inactive
+	err = phpserialize.UnmarshalWithOptions([]byte(`E:11:"Suit:Hearts";`),
+		&result, options)
+	expectErrorToEqual(t, err, errors.New("can not unmarshal enum into Go "+
+		"value of type phpserialize_test.status at offset 0 ($)"))
+}
@@ -0,0 +1,307 @@
+package phpserialize
+
+import (
+	"reflect"
+	"strconv"
+)
+
+// A SyntaxError describes serialized data that is not valid.
+type SyntaxError struct {
+	// Offset is the position in the data where the error was found. When
+	// using a Decoder it is relative to the start of the value.
+	Offset int
+
+	// Expected describes what should have been at Offset. It is either a
+	// type, such as "integer", or a quoted token, such as `";"`.
+	Expected string
+
+	// Found is the quoted data at Offset, or "end of data".
+	Found string
+
+	// Path is the location of the value that contains the error, such as
+	// "$.items[3].price". It is empty when it is not known.
+	Path string
+}
+
+func (e *SyntaxError) Error() string {
+	s := "syntax error at offset " + strconv.Itoa(e.Offset)
+	if e.Path != "" {
+		s += " (" + e.Path + ")"
+	}
+
+	return s + ": expected " + e.Expected + ", found " + e.Found
+}
+
+// An UnmarshalTypeError describes a PHP value that can not be stored in the Go
+// type that it is being decoded into.
+type UnmarshalTypeError struct {
+	// Value is the PHP type of the value, such as "string" or "array".
+	Value string
+
+	// Type is the Go type that the value could not be stored in.
+	Type reflect.Type
+
+	// Offset and Path describe where the value is, the same as they do for
+	// a SyntaxError.
+	Offset int
+	Path   string
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return "can not unmarshal " + e.Value + " into Go value of type " +
+		e.Type.String() + " at offset " + strconv.Itoa(e.Offset) +
+		" (" + e.Path + ")"
+}
+
+// A LimitError is returned when decoding would go over one of the limits in
+// DecodeOptions.
+type LimitError struct {
+	// Limit is the name of the DecodeOptions field, such as "MaxDepth".
+	Limit string
+
+	// Value is the value of the limit.
+	Value int
+
+	// Offset and Path describe where the limit was reached, the same as they
+	// do for a SyntaxError.
+	Offset int
+	Path   string
+}
+
+func (e *LimitError) Error() string {
+	return "exceeded " + e.Limit + " of " + strconv.Itoa(e.Value) +
+		" at offset " + strconv.Itoa(e.Offset) + " (" + e.Path + ")"
+}
+
+// A DisallowedClassError is returned for an object of a class that is not
+// allowed by DecodeOptions.AllowedClasses when
+// DecodeOptions.RejectDisallowedClasses is enabled.
+type DisallowedClassError struct {
+	ClassName string
+
+	// Offset and Path describe where the object is, the same as they do for
+	// a SyntaxError.
+	Offset int
+	Path   string
+}
+
+func (e *DisallowedClassError) Error() string {
+	return "class " + strconv.Quote(e.ClassName) + " is not allowed at offset " +
+		strconv.Itoa(e.Offset) + " (" + e.Path + ")"
+}
+
+// An InvalidUnmarshalError describes an invalid argument passed to Unmarshal.
+// The argument must be a non-nil pointer.
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "can not unmarshal into nil"
+	}
+
+	if e.Type.Kind() != reflect.Ptr {
+		return "can not unmarshal into non-pointer " + e.Type.String()
+	}
+
+	return "can not unmarshal into nil " + e.Type.String()
+}
+
+// newSyntaxError creates a SyntaxError for the data at offset, without a path.
+func newSyntaxError(data []byte, offset int, expected string) *SyntaxError {
+	// A length that is too long will point past the end of the data.
+	if offset > len(data) {
+		offset = len(data)
+	}
+
+	found := "end of data"
+	if offset >= 0 && offset < len(data) {
+		found = strconv.Quote(string(data[offset : offset+1]))
+	}
+
+	return &SyntaxError{Offset: offset, Expected: expected, Found: found}
+}
+
+func (d *decodeState) syntaxError(offset int, expected string) error {
+	// Read the byte at offset, if there is one, so that it can be described.
+	d.fill(offset + 1)
+
+	err := newSyntaxError(d.data, offset-d.base, expected)
+	err.Offset += d.base
+	err.Path = d.pathString()
+
+	return err
+}
+
+// numberError is a syntaxError for a number that could not be parsed. The
+// whole of the number is reported rather than just its first byte.
+func (d *decodeState) numberError(offset int, expected, raw string) error {
+	return &SyntaxError{
+		Offset:   offset,
+		Expected: expected,
+		Found:    strconv.Quote(raw),
+		Path:     d.pathString(),
+	}
+}
+
+func (d *decodeState) typeError(offset int, t reflect.Type) error {
+	return &UnmarshalTypeError{
+		Value:  d.typeName(offset),
+		Type:   t,
+		Offset: offset,
+		Path:   d.pathString(),
+	}
+}
+
+func (d *decodeState) limitError(offset int, limit string, value int) error {
+	return &LimitError{
+		Limit:  limit,
+		Value:  value,
+		Offset: offset,
+		Path:   d.pathString(),
+	}
+}
+
+func (d *decodeState) disallowedClassError(offset int, className string) error {
+	return &DisallowedClassError{
+		ClassName: className,
+		Offset:    offset,
+		Path:      d.pathString(),
+	}
+}
+
+// associativeArrayError is used when an array can not be decoded into a slice
+// because its keys are not 0, 1, 2, etc. The offset is the unexpected key.
+func (d *decodeState) associativeArrayError(offset int, t reflect.Type) error {
+	return &UnmarshalTypeError{
+		Value:  "associative array",
+		Type:   t,
+		Offset: offset,
+		Path:   d.pathString(),
+	}
+}
+
+// indexError is used when the key of an array can not be used as the index of
+// a slice.
+func (d *decodeState) indexError(offset int, index int64, t reflect.Type) error {
+	return &UnmarshalTypeError{
+		Value:  "array index " + strconv.FormatInt(index, 10),
+		Type:   t,
+		Offset: offset,
+		Path:   d.pathString(),
+	}
+}
+
+// overflowError is returned when a number does not fit in the Go type that it
+// is being decoded into, such as i:300; into an int8.
+func (d *decodeState) overflowError(offset int, number string,
+	t reflect.Type) error {
+	return &UnmarshalTypeError{
+		Value:  d.typeName(offset) + " " + number,
+		Type:   t,
+		Offset: offset,
+		Path:   d.pathString(),
+	}
+}
+
+// discardedError is returned when a reference can only be resolved by decoding
+// the value that it refers to again, but a Decoder has already discarded it.
+func (d *decodeState) discardedError(offset int, t reflect.Type) error {
+	return &UnmarshalTypeError{
+		Value:  "reference to a value that has been discarded",
+		Type:   t,
+		Offset: offset,
+		Path:   d.pathString(),
+	}
+}
+
+// typeName is phpTypeName for the value at offset. If a Decoder has discarded
+// the start of the value it can only be the last value that was consumed.
+func (d *decodeState) typeName(offset int) string {
+	if offset < d.base && offset == d.lastOffset {
+		return phpTypeName([]byte{d.lastKind}, 0)
+	}
+
+	d.fill(offset + 1)
+
+	return phpTypeName(d.data, offset-d.base)
+}
+
+// phpTypeName returns the name of the type of the value at offset.
+func phpTypeName(data []byte, offset int) string {
+	if offset < 0 || offset >= len(data) {
+		return "end of data"
+	}
+
+	switch data[offset] {
+	case 'N':
+		return "null"
+	case 'b':
+		return "bool"
+	case 'i':
+		return "int"
+	case 'd':
+		return "float"
+	case 's':
+		return "string"
+	case 'a':
+		return "array"
+	case 'O', 'C':
+		return "object"
+	case 'E':
+		return "enum"
+	case 'r', 'R':
+		return "reference"
+	default:
+		return strconv.Quote(string(data[offset : offset+1]))
+	}
+}
+
+// pushPath is called before the value of each array element or object
+// property is decoded. The key is either an int64 or a string.
+func (d *decodeState) pushPath(key interface{}) {
+	d.path = append(d.path, key)
+}
+
+func (d *decodeState) popPath() {
+	d.path = d.path[:len(d.path)-1]
+}
+
+// pathString formats the path like "$.items[3].price". Keys that are not
+// simple names are quoted, like `$["first name"]`.
+func (d *decodeState) pathString() string {
+	s := "$"
+	for _, key := range d.path {
+		switch k := key.(type) {
+		case int64:
+			s += "[" + strconv.FormatInt(k, 10) + "]"
+
+		case string:
+			if isSimpleName(k) {
+				s += "." + k
+			} else {
+				s += "[" + strconv.Quote(k) + "]"
+			}
+		}
+	}
+
+	return s
+}
+
+func isSimpleName(s string) bool {
+	if s == "" {
+		return false
+	}
+
+	for i, c := range s {
+		switch {
+		case c == '_', c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,79 @@
+package phpserialize_test
+
+import (
+	"github.com/elliotchance/phpserialize"
+	"reflect"
+	"testing"
+)
+
+type errorItem struct {
+	Price int
+}
+
+type errorHolder struct {
+	Items []errorItem
+}
+
+func TestUnmarshalSyntaxError(t *testing.T) {
+	data := `a:1:{s:5:"items";a:2:{i:0;i:1;i:1;a:1:{s:5:"price";i:1x;}}}`
+
+	var result map[interface{}]interface{}
+	err := phpserialize.Unmarshal([]byte(data), &result)
+
+	syntaxErr, ok := err.(*phpserialize.SyntaxError)
+	if !ok {
+		t.Fatalf("Expected *SyntaxError, got %#+v", err)
+	}
+
+	expected := &phpserialize.SyntaxError{
+		Offset:   53,
+		Expected: "integer",
+		Found:    `"1x"`,
+		Path:     "$.items[1].price",
+	}
+	if !reflect.DeepEqual(syntaxErr, expected) {
+		t.Errorf("Expected %#+v, got %#+v", expected, syntaxErr)
+	}
+}
+
+func TestUnmarshalTypeError(t *testing.T) {
+	data := `O:11:"errorHolder":1:{s:5:"items";a:2:{` +
+		`i:0;O:9:"errorItem":1:{s:5:"price";i:10;}` +
+		`i:1;O:9:"errorItem":1:{s:5:"price";s:4:"9.99";}}}`
+
+	var result errorHolder
+	err := phpserialize.Unmarshal([]byte(data), &result)
+
+	typeErr, ok := err.(*phpserialize.UnmarshalTypeError)
+	if !ok {
+		t.Fatalf("Expected *UnmarshalTypeError, got %#+v", err)
+	}
+
+	expected := &phpserialize.UnmarshalTypeError{
+		Value:  "string",
+		Type:   reflect.TypeOf(0),
+		Offset: 115,
+		Path:   "$.items[1].price",
+	}
+	if !reflect.DeepEqual(typeErr, expected) {
+		t.Errorf("Expected %#+v, got %#+v", expected, typeErr)
+	}
+
+	if err.Error() != "can not unmarshal string into Go value of type int at offset 115 ($.items[1].price)" {
+		t.Errorf("Unexpected message: %s", err)
+	}
+}
+
+func TestUnmarshalErrorPathQuoting(t *testing.T) {
+	data := `a:1:{s:10:"first name";a:1:{s:2:"1a";i:;}}`
+
+	var result map[interface{}]interface{}
+	err := phpserialize.Unmarshal([]byte(data), &result)
+
+	expectErrorToEqual(t, err, &phpserialize.SyntaxError{
+		Offset:   39,
+		Expected: "integer",
+		Found:    `""`,
+		Path:     `$["first name"]["1a"]`,
+	})
+}
@@ -0,0 +1,192 @@
+package phpserialize
+
+import (
+	"math"
+	"strconv"
+)
+
+// appendFloat appends value the same way that serialize() writes floats in PHP
+// 7.1 and later, with the default serialize_precision of -1. That is the
+// shortest number of digits that will be decoded as exactly the same value,
+// using an exponent like "1.0E+25" for numbers that are very large or very
+// small. INF, -INF and NAN are also written the same way as PHP.
+func appendFloat(dst []byte, value float64, bitSize int) []byte {
+	return appendFloatPrecision(dst, value, -1, bitSize)
+}
+
+// castPrecision is the default precision setting of PHP, which is the number of
+// significant digits used when a float is converted into a string.
+const castPrecision = 14
+
+// appendFloatPrecision appends value with at most precision significant digits
+// the same way as PHP, or the shortest number of digits that will be decoded
+// as exactly the same value if precision is -1. An exponent is used when the
+// decimal point would be more than precision digits (17 digits for -1) to the
+// right of the first digit, or more than 4 digits to the left.
+func appendFloatPrecision(dst []byte, value float64, precision,
+	bitSize int) []byte {
+	switch {
+	case math.IsNaN(value):
+		return append(dst, "NAN"...)
+
+	case math.IsInf(value, 1):
+		return append(dst, "INF"...)
+
+	case math.IsInf(value, -1):
+		return append(dst, "-INF"...)
+	}
+
+	// strconv finds the digits, such as "-1.2345e+07". PHP formats them
+	// based on the position of the decimal point in the digits.
+	maxPoint := 17
+	if precision >= 0 {
+		maxPoint = precision
+		precision--
+	}
+
+	var buf [32]byte
+	s := strconv.AppendFloat(buf[:0], value, 'e', precision, bitSize)
+	if s[0] == '-' {
+		dst = append(dst, '-')
+		s = s[1:]
+	}
+
+	e := 1
+	for s[e] != 'e' {
+		e++
+	}
+
+	exponent, _ := strconv.Atoi(string(s[e+1:]))
+	point := exponent + 1
+
+	var digitsBuf [24]byte
+	digits := append(digitsBuf[:0], s[0])
+	if e > 1 {
+		digits = append(digits, s[2:e]...)
+	}
+
+	// A fixed precision can leave zeros at the end, which PHP removes.
+	for len(digits) > 1 && digits[len(digits)-1] == '0' {
+		digits = digits[:len(digits)-1]
+	}
+
+	switch {
+	case point < -3 || point > maxPoint:
+		dst = append(dst, digits[0], '.')
+		if len(digits) == 1 {
+			dst = append(dst, '0')
+		} else {
+			dst = append(dst, digits[1:]...)
+		}
+
+		dst = append(dst, 'E')
+		if exponent < 0 {
+			dst = append(dst, '-')
+			exponent = -exponent
+		} else {
+			dst = append(dst, '+')
+		}
+
+		return strconv.AppendInt(dst, int64(exponent), 10)
+
+	case point <= 0:
+		dst = append(dst, '0', '.')
+		for i := point; i < 0; i++ {
+			dst = append(dst, '0')
+		}
+
+		return append(dst, digits...)
+	}
+
+	for i := 0; i < point; i++ {
+		if i < len(digits) {
+			dst = append(dst, digits[i])
+		} else {
+			dst = append(dst, '0')
+		}
+	}
+
+	if len(digits) > point {
+		dst = append(dst, '.')
+		dst = append(dst, digits[point:]...)
+	}
+
+	return dst
+}
+
+// parseFloat parses a float in any of the formats that PHP's unserialize()
+// accepts: an optionally signed integer or decimal, with or without an
+// exponent, or INF, -INF or NAN.
+func parseFloat(s string) (float64, bool) {
+	switch s {
+	case "INF":
+		return math.Inf(1), true
+
+	case "-INF":
+		return math.Inf(-1), true
+
+	case "NAN":
+		return math.NaN(), true
+	}
+
+	if !isFloat(s) {
+		return 0, false
+	}
+
+	// Numbers that are too large are infinite, the same as in PHP.
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil && err.(*strconv.NumError).Err != strconv.ErrRange {
+		return 0, false
+	}
+
+	return v, true
+}
+
+func isFloat(s string) bool {
+	i := skipSign(s, 0)
+
+	digits := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+		digits++
+	}
+
+	if i < len(s) && s[i] == '.' {
+		i++
+		for i < len(s) && isDigit(s[i]) {
+			i++
+			digits++
+		}
+	}
+
+	if digits == 0 {
+		return false
+	}
+
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i = skipSign(s, i+1)
+
+		start := i
+		for i < len(s) && isDigit(s[i]) {
+			i++
+		}
+
+		if i == start {
+			return false
+		}
+	}
+
+	return i == len(s)
+}
+
+func skipSign(s string, i int) int {
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		return i + 1
+	}
+
+	return i
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,121 @@
+package phpserialize_test
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/elliotchance/phpserialize"
+)
+
+// floatGolden is what PHP 7.1 and later (with the default serialize_precision
+// of -1) writes for each float.
+var floatGolden = []struct {
+	value float64
+	php   string
+}{
+	{0, "d:0;"},
+	{math.Copysign(0, -1), "d:-0;"},
+	{1, "d:1;"},
+	{-1.5, "d:-1.5;"},
+	{0.1, "d:0.1;"},
+	{0.30000000000000004, "d:0.30000000000000004;"},
+	{1.0 / 3, "d:0.3333333333333333;"},
+	{123.456789, "d:123.456789;"},
+	{1.23e9, "d:1230000000;"},
+	{1e15, "d:1000000000000000;"},
+	{1e16, "d:10000000000000000;"},
+	{1e17, "d:1.0E+17;"},
+	{1.2345678901234568e17, "d:1.2345678901234568E+17;"},
+	{1e25, "d:1.0E+25;"},
+	{-1.5e300, "d:-1.5E+300;"},
+	{math.MaxFloat64, "d:1.7976931348623157E+308;"},
+	{0.0001, "d:0.0001;"},
+	{0.00012, "d:0.00012;"},
+	{0.00001, "d:1.0E-5;"},
+	{-1.5e-7, "d:-1.5E-7;"},
+	{5e-324, "d:5.0E-324;"},
+	{math.Inf(1), "d:INF;"},
+	{math.Inf(-1), "d:-INF;"},
+	{math.NaN(), "d:NAN;"},
+}
+
+func TestMarshalFloatGolden(t *testing.T) {
+	for _, test := range floatGolden {
+		t.Run(test.php, func(t *testing.T) {
+			result := phpserialize.MarshalFloat(test.value, 64)
+			if string(result) != test.php {
+				t.Errorf("Expected %s, got %s", test.php, result)
+			}
+
+			encoded, err := phpserialize.Marshal(test.value, nil)
+			expectErrorToNotHaveOccurred(t, err)
+
+			if string(encoded) != test.php {
+				t.Errorf("Expected %s, got %s", test.php, encoded)
+			}
+		})
+	}
+}
+
+func TestUnmarshalFloatGolden(t *testing.T) {
+	for _, test := range floatGolden {
+		t.Run(test.php, func(t *testing.T) {
+			result, err := phpserialize.UnmarshalFloat([]byte(test.php))
+			expectErrorToNotHaveOccurred(t, err)
+
+			if math.IsNaN(test.value) {
+				if !math.IsNaN(result) {
+					t.Errorf("Expected NaN, got %v", result)
+				}
+				return
+			}
+
+			if result != test.value ||
+				math.Signbit(result) != math.Signbit(test.value) {
+				t.Errorf("Expected %v, got %v", test.value, result)
+			}
+		})
+	}
+}
+
+func TestUnmarshalFloatFormats(t *testing.T) {
+	tests := map[string]float64{
+		"d:1.;":     1,
+		"d:.5;":     0.5,
+		"d:+2;":     2,
+		"d:1e3;":    1000,
+		"d:1.5E-2;": 0.015,
+		"d:1e999;":  math.Inf(1),
+	}
+
+	for input, expected := range tests {
+		t.Run(input, func(t *testing.T) {
+			result, err := phpserialize.UnmarshalFloat([]byte(input))
+			expectErrorToNotHaveOccurred(t, err)
+
+			if result != expected {
+				t.Errorf("Expected %v, got %v", expected, result)
+			}
+		})
+	}
+}
+
+func TestUnmarshalInvalidFloat(t *testing.T) {
+	for _, input := range []string{"inf", "NaN", "Infinity", "0x1p3", ".",
+		"1e", "1.5.", "- 1", ""} {
+		t.Run(input, func(t *testing.T) {
+			_, err := phpserialize.UnmarshalFloat([]byte("d:" + input + ";"))
+			expectErrorToEqual(t, err, errors.New(
+				`syntax error at offset 2 ($): expected float, found "`+
+					input+`"`))
+		})
+	}
+}
+
+func TestMarshalFloat32(t *testing.T) {
+	result := phpserialize.MarshalFloat(float64(float32(0.1)), 32)
+	if string(result) != "d:0.1;" {
+		t.Errorf("Expected d:0.1;, got %s", result)
+	}
+}
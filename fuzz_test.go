@@ -0,0 +1,16 @@
+//go:build go1.18
+// +build go1.18
+
+package phpserialize_test
+
+import "testing"
+
+func FuzzUnmarshal(f *testing.F) {
+	for _, data := range malformedCorpus {
+		f.Add([]byte(data))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeMalformed(data)
+	})
+}
@@ -0,0 +1,133 @@
+package phpserialize
+
+import (
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// juggle converts a generic value into the PHP type that is stored in t, the
+// same way PHP converts types. It is only used with DecodeOptions.TypeJuggling.
+//
+// Values that PHP can not convert, such as a string that is not numeric into
+// an integer, are returned as they are so that assignValue returns an
+// *UnmarshalTypeError.
+func (d *decodeState) juggle(offset int, t reflect.Type,
+	value interface{}) (interface{}, error) {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		switch v := value.(type) {
+		case bool:
+			if v {
+				return int64(1), nil
+			}
+
+			return int64(0), nil
+
+		case float64:
+			return d.truncateFloat(offset, t, v)
+
+		case string:
+			if n, ok := numericString(v); ok {
+				if f, ok := n.(float64); ok {
+					return d.truncateFloat(offset, t, f)
+				}
+
+				return n, nil
+			}
+		}
+
+	case reflect.Float32, reflect.Float64:
+		switch v := value.(type) {
+		case bool:
+			if v {
+				return float64(1), nil
+			}
+
+			return float64(0), nil
+
+		case int64:
+			return float64(v), nil
+
+		case string:
+			if n, ok := numericString(v); ok {
+				if i, ok := n.(int64); ok {
+					return float64(i), nil
+				}
+
+				return n, nil
+			}
+		}
+
+	case reflect.Bool:
+		switch v := value.(type) {
+		case int64:
+			return v != 0, nil
+
+		case float64:
+			// NaN is true in PHP, as it is not equal to zero.
+			return v != 0, nil
+
+		case string:
+			return v != "" && v != "0", nil
+		}
+
+	case reflect.String, reflect.Slice:
+		if t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8 {
+			break
+		}
+
+		switch v := value.(type) {
+		case bool:
+			if v {
+				return "1", nil
+			}
+
+			return "", nil
+
+		case int64:
+			return strconv.FormatInt(v, 10), nil
+
+		case float64:
+			// PHP uses fewer digits than serialize() when it converts
+			// a float into a string.
+			return string(appendFloatPrecision(nil, v, castPrecision,
+				64)), nil
+		}
+	}
+
+	return value, nil
+}
+
+// truncateFloat converts a float into an integer by discarding the fraction.
+// Unlike PHP, floats that are not finite or do not fit in an int64 return an
+// *UnmarshalTypeError rather than an undefined integer.
+func (d *decodeState) truncateFloat(offset int, t reflect.Type,
+	f float64) (interface{}, error) {
+	f = math.Trunc(f)
+	if math.IsNaN(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return nil, d.overflowError(offset, string(appendFloat(nil, f, 64)), t)
+	}
+
+	return int64(f), nil
+}
+
+// numericString returns the int64 or float64 value of s if it is a numeric
+// string, as defined by PHP's is_numeric(). Leading and trailing whitespace is
+// allowed. Integers that are too large for an int64 are floats, as they are in
+// PHP.
+func numericString(s string) (interface{}, bool) {
+	s = strings.Trim(s, " \t\n\r\v\f")
+	if !isFloat(s) {
+		return nil, false
+	}
+
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, true
+	}
+
+	return parseFloat(s)
+}
@@ -0,0 +1,170 @@
+package phpserialize_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/elliotchance/phpserialize"
+)
+
+func jugglingOptions() *phpserialize.DecodeOptions {
+	options := phpserialize.DefaultDecodeOptions()
+	options.TypeJuggling = true
+
+	return options
+}
+
+func TestUnmarshalTypeJuggling(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		target   interface{}
+		expected interface{}
+	}{
+		"string to int":          {`s:2:"42";`, new(int), 42},
+		"signed string to int":   {`s:3:"-42";`, new(int), -42},
+		"spaces to int":          {"s:5:\" 12 \n\";", new(int), 12},
+		"float string to int":    {`s:4:"9.99";`, new(int), 9},
+		"exponent string to int": {`s:3:"1e3";`, new(int64), int64(1000)},
+		"float to int":           {"d:-3.7;", new(int32), int32(-3)},
+		"bool to int":            {"b:1;", new(uint8), uint8(1)},
+		"null to int":            {"N;", new(int), 0},
+		"string to float":        {`s:4:"9.99";`, new(float64), 9.99},
+		"int string to float":    {`s:2:"10";`, new(float32), float32(10)},
+		"int to float":           {"i:3;", new(float64), 3.0},
+		"bool to float":          {"b:0;", new(float64), 0.0},
+		"int to bool":            {"i:1;", new(bool), true},
+		"zero to bool":           {"i:0;", new(bool), false},
+		"float to bool":          {"d:0.5;", new(bool), true},
+		"empty string to bool":   {`s:0:"";`, new(bool), false},
+		"zero string to bool":    {`s:1:"0";`, new(bool), false},
+		"string to bool":         {`s:3:"0.0";`, new(bool), true},
+		"null to bool":           {"N;", new(bool), false},
+		"int to string":          {"i:-5;", new(string), "-5"},
+		"float to string":        {"d:0.1;", new(string), "0.1"},
+		"large float to string":  {"d:1.0E+25;", new(string), "1.0E+25"},
+		"rounded float string":   {"d:0.30000000000000004;", new(string), "0.3"},
+		"1e15 to string":         {"d:1.0E+15;", new(string), "1.0E+15"},
+		"1e13 to string":         {"d:1.0E+13;", new(string), "10000000000000"},
+		"small float string":     {"d:0.0001;", new(string), "0.0001"},
+		"tiny float string":      {"d:1.0E-5;", new(string), "1.0E-5"},
+		"long float string":      {"d:123456789.12345678;", new(string), "123456789.12346"},
+		"float to bytes":         {"d:0.1;", new([]byte), []byte("0.1")},
+		"true to string":         {"b:1;", new(string), "1"},
+		"false to string":        {"b:0;", new(string), ""},
+		"null to string":         {"N;", new(string), ""},
+		"int to bytes":           {"i:7;", new([]byte), []byte("7")},
+		"string to string":       {`s:3:"abc";`, new(string), "abc"},
+		"int to interface":       {"i:7;", new(interface{}), int64(7)},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			err := phpserialize.UnmarshalWithOptions([]byte(test.input),
+				test.target, jugglingOptions())
+			expectErrorToNotHaveOccurred(t, err)
+
+			result := reflect.ValueOf(test.target).Elem().Interface()
+			if !reflect.DeepEqual(result, test.expected) {
+				t.Errorf("Expected %#v, got %#v", test.expected, result)
+			}
+		})
+	}
+}
+
+type product struct {
+	ID       int     `php:"id"`
+	Price    float64 `php:"price"`
+	Active   bool    `php:"active"`
+	SKU      string  `php:"sku"`
+	Quantity *int    `php:"quantity"`
+}
+
+func TestUnmarshalTypeJugglingFields(t *testing.T) {
+	input := `a:5:{s:2:"id";d:12;s:5:"price";s:4:"9.99";s:6:"active";i:1;` +
+		`s:3:"sku";i:1234;s:8:"quantity";s:1:"3";}`
+
+	var result product
+	err := phpserialize.UnmarshalWithOptions([]byte(input), &result,
+		jugglingOptions())
+	expectErrorToNotHaveOccurred(t, err)
+
+	if result.ID != 12 || result.Price != 9.99 || !result.Active ||
+		result.SKU != "1234" || result.Quantity == nil || *result.Quantity != 3 {
+		t.Errorf("Unexpected %+v", result)
+	}
+
+	// Null replaces values that are already set.
+	input = `a:3:{s:2:"id";N;s:3:"sku";N;s:8:"quantity";N;}`
+	err = phpserialize.UnmarshalWithOptions([]byte(input), &result,
+		jugglingOptions())
+	expectErrorToNotHaveOccurred(t, err)
+
+	if result.ID != 0 || result.SKU != "" || result.Quantity != nil ||
+		result.Price != 9.99 {
+		t.Errorf("Unexpected %+v", result)
+	}
+
+	var ids []int
+	err = phpserialize.UnmarshalWithOptions(
+		[]byte(`a:3:{i:0;s:1:"1";i:1;d:2;i:2;b:1;}`), &ids, jugglingOptions())
+	expectErrorToNotHaveOccurred(t, err)
+
+	if !reflect.DeepEqual(ids, []int{1, 2, 1}) {
+		t.Errorf("Unexpected %v", ids)
+	}
+}
+
+func TestUnmarshalTypeJugglingErrors(t *testing.T) {
+	tests := map[string]struct {
+		input         string
+		target        interface{}
+		expectedError string
+	}{
+		"not numeric": {`s:3:"abc";`, new(int),
+			"can not unmarshal string into Go value of type int at offset 0 ($)"},
+		"leading numeric": {`s:3:"12a";`, new(int),
+			"can not unmarshal string into Go value of type int at offset 0 ($)"},
+		"empty string": {`s:0:"";`, new(float64),
+			"can not unmarshal string into Go value of type float64 at offset 0 ($)"},
+		"INF string": {`s:3:"INF";`, new(float64),
+			"can not unmarshal string into Go value of type float64 at offset 0 ($)"},
+		"overflow": {`s:3:"300";`, new(int8),
+			"can not unmarshal string 300 into Go value of type int8 at offset 0 ($)"},
+		"negative uint": {"d:-1.5;", new(uint), "can not unmarshal float -1 " +
+			"into Go value of type uint at offset 0 ($)"},
+		"infinite float": {"d:INF;", new(int64),
+			"can not unmarshal float INF into Go value of type int64 at offset 0 ($)"},
+		"large float": {"d:1.0E+19;", new(int64), "can not unmarshal float " +
+			"1.0E+19 into Go value of type int64 at offset 0 ($)"},
+		"array": {"a:0:{}", new(string),
+			"can not unmarshal array into Go value of type string at offset 0 ($)"},
+		"field": {`a:1:{s:2:"id";s:1:"x";}`, new(product),
+			`can not unmarshal string into Go value of type int at offset 14 ($.id)`},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			err := phpserialize.UnmarshalWithOptions([]byte(test.input),
+				test.target, jugglingOptions())
+			expectErrorToEqual(t, err, errors.New(test.expectedError))
+		})
+	}
+}
+
+func TestUnmarshalWithoutTypeJuggling(t *testing.T) {
+	var i int
+	err := phpserialize.Unmarshal([]byte(`s:2:"42";`), &i)
+	expectErrorToEqual(t, err, errors.New(
+		`syntax error at offset 0 ($): expected integer, found "s"`))
+
+	var result product
+	err = phpserialize.Unmarshal([]byte(`a:1:{s:5:"price";s:4:"9.99";}`),
+		&result)
+	expectErrorToEqual(t, err, errors.New("can not unmarshal string into Go "+
+		"value of type float64 at offset 17 ($.price)"))
+
+	err = phpserialize.Unmarshal([]byte(`a:1:{i:0;d:NAN;}`), &[]bool{})
+	expectErrorToEqual(t, err, errors.New("can not unmarshal float into Go "+
+		"value of type bool at offset 9 ($[0])"))
+}
@@ -0,0 +1,262 @@
+package phpserialize
+
+import "reflect"
+
+// PHPProperty is a single property of an object, in the order that it was
+// serialized. The Name is exactly as PHP serialized it, see ParsePropertyName
+// for names of protected and private properties.
+type PHPProperty struct {
+	Name  string
+	Value interface{}
+}
+
+// PHPObject is an object with its class name and its properties in the order
+// that they were serialized. Objects are decoded as a *PHPObject when the
+// PreserveObjects option is enabled, or when decoding into a PHPObject. Marshal
+// will encode exactly the same object again.
+type PHPObject struct {
+	ClassName  string
+	Properties []PHPProperty
+}
+
+// Property returns the value of the property with the name, which is exactly
+// as PHP serialized it. The second return value is false if there is no such
+// property.
+func (o *PHPObject) Property(name string) (interface{}, bool) {
+	for _, property := range o.Properties {
+		if property.Name == name {
+			return property.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+// SetProperty changes the value of a property. A new property is added to the
+// end if there is no property with the name.
+func (o *PHPObject) SetProperty(name string, value interface{}) {
+	for i := range o.Properties {
+		if o.Properties[i].Name == name {
+			o.Properties[i].Value = value
+			return
+		}
+	}
+
+	o.Properties = append(o.Properties, PHPProperty{name, value})
+}
+
+var phpObjectType = reflect.TypeOf(PHPObject{})
+
+// PHPIncompleteClass is an object of a class that was not allowed by
+// DecodeOptions.AllowedClasses. It is the equivalent of PHP's
+// __PHP_Incomplete_Class: the class name and properties are kept as they were
+// so that Marshal will encode the same object again.
+type PHPIncompleteClass struct {
+	ClassName  string
+	Properties []PHPProperty
+}
+
+// AllowClasses returns a function for DecodeOptions.AllowedClasses that only
+// allows the classes named. Like PHP, class names are case-insensitive and may
+// start with a backslash. Calling AllowClasses without any class names will
+// allow no classes at all.
+func AllowClasses(classNames ...string) func(className string) bool {
+	allowed := map[string]bool{}
+	for _, className := range classNames {
+		allowed[registryKey(className)] = true
+	}
+
+	return func(className string) bool {
+		return allowed[registryKey(className)]
+	}
+}
+
+func (d *decodeState) classAllowed(className string) bool {
+	return d.options.AllowedClasses == nil || d.options.AllowedClasses(className)
+}
+
+// consumeClassName consumes the start of an object (or custom object) up to
+// and including the ':' after the class name.
+func (d *decodeState) consumeClassName(offset int, t byte, expected string) (string, int, error) {
+	offset, err := d.consumeHeader(offset, t, expected)
+	if err != nil {
+		return "", -1, err
+	}
+
+	return d.consumeStringRealPart(offset, ':')
+}
+
+// consumeGenericObject consumes an object when there is no Go type to guide
+// it. Objects are decoded as maps, unless there is a Go type registered for
+// the class, the class is not allowed or objects are being preserved.
+func (d *decodeState) consumeGenericObject(offset int) (interface{}, int, error) {
+	index := d.addSlot(offset, reflect.Value{})
+
+	start := offset
+	className, offset, err := d.consumeClassName(offset, 'O', "object")
+	if err != nil {
+		return nil, -1, err
+	}
+
+	if d.classAllowed(className) {
+		if t := d.registry.typeOf(className); t != nil {
+			return d.consumeRegisteredObject(index, offset, t)
+		}
+
+		if d.options.PreserveObjects {
+			result := &PHPObject{ClassName: className}
+			d.slot(index).value = genericValue(result)
+
+			offset, err = d.consumeOrderedProperties(offset, &result.Properties)
+			if err != nil {
+				return nil, -1, err
+			}
+
+			return result, offset, nil
+		}
+
+		return d.consumeMapProperties(index, offset)
+	}
+
+	if d.options.RejectDisallowedClasses {
+		return nil, -1, d.disallowedClassError(start, className)
+	}
+
+	result := &PHPIncompleteClass{ClassName: className}
+	d.slot(index).value = genericValue(result)
+
+	offset, err = d.consumeOrderedProperties(offset, &result.Properties)
+	if err != nil {
+		return nil, -1, err
+	}
+
+	return result, offset, nil
+}
+
+// fillPHPObject consumes an object into v, which is a PHPObject.
+func (d *decodeState) fillPHPObject(offset int, v reflect.Value) (int, error) {
+	d.addSlot(offset, v)
+
+	className, offset, err := d.consumeClassName(offset, 'O', "object")
+	if err != nil {
+		return -1, err
+	}
+
+	result := PHPObject{ClassName: className}
+	offset, err = d.consumeOrderedProperties(offset, &result.Properties)
+	if err != nil {
+		return -1, err
+	}
+
+	v.Set(reflect.ValueOf(result))
+
+	return offset, nil
+}
+
+// consumeOrderedProperties consumes the properties of an object into a slice
+// so that their order is kept.
+func (d *decodeState) consumeOrderedProperties(offset int,
+	properties *[]PHPProperty) (int, error) {
+	return d.consumeProperties(offset, func(key string, value interface{}) {
+		*properties = append(*properties, PHPProperty{key, value})
+	})
+}
+
+// consumeRegisteredObject consumes the properties of an object into a new value
+// of the Go type t that was registered for its class.
+func (d *decodeState) consumeRegisteredObject(index, offset int, t reflect.Type) (
+	interface{}, int, error) {
+	// The struct is recorded before its fields are decoded so that
+	// references inside of it can point back to it.
+	var ptr reflect.Value
+	if t.Kind() == reflect.Ptr {
+		ptr = reflect.New(t.Elem())
+		d.slot(index).value = genericValue(ptr.Interface())
+	} else {
+		ptr = reflect.New(t)
+		d.slot(index).value = ptr.Elem()
+	}
+
+	offset, err := d.fillFields(offset, ptr.Elem())
+	if err != nil {
+		return nil, -1, err
+	}
+
+	if t.Kind() == reflect.Ptr {
+		return ptr.Interface(), offset, nil
+	}
+
+	result := ptr.Elem().Interface()
+	d.slot(index).value = genericValue(result)
+
+	return result, offset, nil
+}
+
+// consumeMapProperties consumes the properties of an object into a map that
+// is stored in the slot at index.
+func (d *decodeState) consumeMapProperties(index, offset int) (
+	map[interface{}]interface{}, int, error) {
+	result := map[interface{}]interface{}{}
+	d.slot(index).value = genericValue(result)
+
+	offset, err := d.consumeProperties(offset, func(key string, value interface{}) {
+		result[key] = value
+	})
+	if err != nil {
+		return nil, -1, err
+	}
+
+	return result, offset, nil
+}
+
+// consumeProperties consumes the number of properties of an object and then
+// each of the properties in order.
+func (d *decodeState) consumeProperties(offset int,
+	add func(key string, value interface{})) (int, error) {
+	length, offset, err := d.consumeCount(offset, mapElementSize)
+	if err != nil {
+		return -1, err
+	}
+
+	for i := 0; i < length; i++ {
+		var key string
+		var value interface{}
+
+		// The key should always be a string. I am not completely sure
+		// about this.
+		key, offset, err = d.consumeString(offset)
+		if err != nil {
+			return -1, err
+		}
+
+		d.pushPath(key)
+		value, offset, err = d.consumeNext(offset)
+		if err != nil {
+			return -1, err
+		}
+		d.popPath()
+
+		add(key, value)
+	}
+
+	return d.consumeEnd(offset)
+}
+
+// marshalProperties encodes a PHPObject or PHPIncompleteClass.
+func (e *encodeState) marshalProperties(className string,
+	properties []PHPProperty) error {
+	e.writeObjectHeader(className, len(properties))
+
+	for _, property := range properties {
+		e.writeString(property.Name)
+
+		err := e.marshal(property.Value)
+		if err != nil {
+			return err
+		}
+	}
+
+	e.w.WriteByte('}')
+
+	return nil
+}
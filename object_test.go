@@ -0,0 +1,246 @@
+package phpserialize_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/elliotchance/phpserialize"
+)
+
+const allowedClassesData = `a:2:{` +
+	`i:0;O:8:"stdClass":1:{s:1:"a";i:1;}` +
+	`i:1;O:3:"Foo":2:{s:1:"b";r:3;s:1:"c";a:0:{}}}`
+
+func TestUnmarshalAllowedClasses(t *testing.T) {
+	options := phpserialize.DefaultDecodeOptions()
+	options.AllowedClasses = phpserialize.AllowClasses("\\STDCLASS")
+
+	var result []interface{}
+	err := phpserialize.UnmarshalWithOptions([]byte(allowedClassesData),
+		&result, options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := []interface{}{
+		map[interface{}]interface{}{"a": int64(1)},
+		&phpserialize.PHPIncompleteClass{
+			ClassName: "Foo",
+			Properties: []phpserialize.PHPProperty{
+				{"b", int64(1)},
+				{"c", []interface{}{}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %#+v, got %#+v", expected, result)
+	}
+}
+
+func TestUnmarshalRejectDisallowedClasses(t *testing.T) {
+	options := phpserialize.DefaultDecodeOptions()
+	options.AllowedClasses = phpserialize.AllowClasses("stdClass")
+	options.RejectDisallowedClasses = true
+
+	var result []interface{}
+	err := phpserialize.UnmarshalWithOptions([]byte(allowedClassesData),
+		&result, options)
+
+	expectErrorToEqual(t, err,
+		errors.New(`class "Foo" is not allowed at offset 44 ($[1])`))
+}
+
+func TestUnmarshalDisallowedCustomObject(t *testing.T) {
+	data := `a:1:{i:0;C:11:"ArrayObject":21:{x:i:0;a:0:{};m:a:0:{}}}`
+
+	options := newArrayObjectOptions()
+	options.AllowedClasses = phpserialize.AllowClasses()
+
+	var result []interface{}
+	err := phpserialize.UnmarshalWithOptions([]byte(data), &result, options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	// The registered decoder is not used.
+	expected := []interface{}{
+		&phpserialize.PHPCustomObject{
+			ClassName: "ArrayObject",
+			Payload:   []byte("x:i:0;a:0:{};m:a:0:{}"),
+		},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %#+v, got %#+v", expected, result)
+	}
+}
+
+func TestMarshalIncompleteClass(t *testing.T) {
+	options := phpserialize.DefaultDecodeOptions()
+	options.AllowedClasses = phpserialize.AllowClasses()
+
+	data := `O:3:"Foo":2:{s:1:"a";i:1;s:6:"` + "\x00*\x00" + `bar";s:1:"x";}`
+
+	var result []interface{}
+	err := phpserialize.UnmarshalWithOptions([]byte(`a:1:{i:0;`+data+`}`),
+		&result, options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	out, err := phpserialize.Marshal(result[0], nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if string(out) != data {
+		t.Errorf("Expected %q, got %q", data, out)
+	}
+}
+
+type registeredUser struct {
+	Name   string
+	Secret string `php:"secret,private"`
+	Friend *registeredUser
+}
+
+func newUserRegistry() *phpserialize.Registry {
+	registry := phpserialize.NewRegistry()
+	registry.Register("App\\Models\\User", &registeredUser{})
+
+	return registry
+}
+
+func TestUnmarshalRegisteredClass(t *testing.T) {
+	data := `a:1:{i:0;O:15:"App\Models\User":3:{` +
+		`s:4:"name";s:3:"Bob";` +
+		`s:23:"` + "\x00App\\Models\\User\x00" + `secret";s:1:"x";` +
+		`s:6:"friend";r:2;}}`
+
+	options := phpserialize.DefaultDecodeOptions()
+	options.Registry = newUserRegistry()
+
+	var result []interface{}
+	err := phpserialize.UnmarshalWithOptions([]byte(data), &result, options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	user, ok := result[0].(*registeredUser)
+	if !ok {
+		t.Fatalf("Expected *registeredUser, got %#+v", result[0])
+	}
+
+	if user.Name != "Bob" || user.Secret != "x" || user.Friend != user {
+		t.Errorf("Unexpected value: %#+v", user)
+	}
+}
+
+func TestUnmarshalRegisteredClassByValue(t *testing.T) {
+	registry := phpserialize.NewRegistry()
+	registry.Register("stdClass", Struct2{})
+
+	options := phpserialize.DefaultDecodeOptions()
+	options.Registry = registry
+
+	var result map[interface{}]interface{}
+	err := phpserialize.UnmarshalWithOptions(
+		[]byte(`a:1:{s:1:"a";O:8:"stdclass":1:{s:3:"qux";d:1.5;}}`),
+		&result, options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := map[interface{}]interface{}{"a": Struct2{Qux: 1.5}}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %#+v, got %#+v", expected, result)
+	}
+}
+
+func TestMarshalRegisteredClass(t *testing.T) {
+	options := phpserialize.DefaultMarshalOptions()
+	options.Registry = newUserRegistry()
+
+	result, err := phpserialize.MarshalStruct(
+		registeredUser{Name: "Bob", Secret: "x"}, options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := `O:15:"App\Models\User":3:{` +
+		`s:4:"name";s:3:"Bob";` +
+		`s:23:"` + "\x00App\\Models\\User\x00" + `secret";s:1:"x";` +
+		`s:6:"friend";N;}`
+	if string(result) != expected {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+}
+
+func TestRegisterInvalidType(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected a panic")
+		}
+	}()
+
+	phpserialize.NewRegistry().Register("Foo", 123)
+}
+
+func TestUnmarshalPreserveObjects(t *testing.T) {
+	data := `a:2:{i:0;O:4:"User":2:{s:4:"name";s:3:"Bob";s:3:"age";i:30;}i:1;r:2;}`
+
+	options := phpserialize.DefaultDecodeOptions()
+	options.PreserveObjects = true
+
+	var result []interface{}
+	err := phpserialize.UnmarshalWithOptions([]byte(data), &result, options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := &phpserialize.PHPObject{
+		ClassName: "User",
+		Properties: []phpserialize.PHPProperty{
+			{"name", "Bob"},
+			{"age", int64(30)},
+		},
+	}
+	if !reflect.DeepEqual(result[0], expected) {
+		t.Errorf("Expected %#+v, got %#+v", expected, result[0])
+	}
+
+	if result[1] != result[0] {
+		t.Errorf("Expected the reference to be the same object, got %#+v",
+			result[1])
+	}
+}
+
+func TestMarshalPHPObject(t *testing.T) {
+	data := `O:4:"User":2:{s:4:"name";s:3:"Bob";s:6:"` + "\x00*\x00" + `age";i:30;}`
+
+	options := phpserialize.DefaultDecodeOptions()
+	options.PreserveObjects = true
+
+	var result []interface{}
+	err := phpserialize.UnmarshalWithOptions([]byte(`a:1:{i:0;`+data+`}`),
+		&result, options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	object := result[0].(*phpserialize.PHPObject)
+	object.SetProperty("name", "Alice")
+
+	if value, ok := object.Property("\x00*\x00age"); !ok || value != int64(30) {
+		t.Errorf("Expected 30, got %#+v", value)
+	}
+
+	out, err := phpserialize.Marshal(object, nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := `O:4:"User":2:{s:4:"name";s:5:"Alice";s:6:"` + "\x00*\x00" + `age";i:30;}`
+	if string(out) != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+}
+
+func TestUnmarshalIntoPHPObject(t *testing.T) {
+	data := `O:8:"stdClass":1:{s:1:"a";O:3:"Foo":0:{}}`
+
+	var result phpserialize.PHPObject
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	// Nested objects still follow the options.
+	expected := phpserialize.PHPObject{
+		ClassName: "stdClass",
+		Properties: []phpserialize.PHPProperty{
+			{"a", map[interface{}]interface{}{}},
+		},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %#+v, got %#+v", expected, result)
+	}
+}
@@ -0,0 +1,179 @@
+package phpserialize
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// CustomUnserializeFunc decodes the payload of a custom serialized object. The
+// payload is the raw bytes between the braces of a "C:" record. It is whatever
+// the serialize() method of the PHP class returned, which often contains
+// serialized values. They should be decoded with dec so that references are
+// numbered the same way as PHP, see PayloadDecoder.
+type CustomUnserializeFunc func(payload []byte,
+	dec *PayloadDecoder) (interface{}, error)
+
+// Registry maps PHP class names to the Go code that handles them.
+//
+// PHP class names are case-insensitive and so are the lookups in a Registry. A
+// Registry is safe for concurrent use.
+type Registry struct {
+	mu     sync.RWMutex
+	custom map[string]CustomUnserializeFunc
+
+	// types holds the Go type registered for each class and names holds
+	// the class name registered for each struct type.
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+
+	enums map[string]registeredEnum
+}
+
+// DefaultRegistry is used when decoding unless another Registry is provided.
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry creates an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		custom: map[string]CustomUnserializeFunc{},
+		types:  map[string]reflect.Type{},
+		names:  map[reflect.Type]string{},
+		enums:  map[string]registeredEnum{},
+	}
+}
+
+// Register maps a PHP class name, such as "App\Models\User", to the Go type
+// of value. The value must be a struct or a pointer to a struct:
+//
+//	registry.Register("App\Models\User", &User{})
+//
+// When decoding into an interface{}, objects of the class will be decoded into
+// a new value of the same type as value (a *User in this case) instead of a
+// map. When encoding, the struct uses the class name instead of the name of
+// the Go type.
+//
+// Registering the same class name or type again will replace the existing
+// registration. Register panics if value is not a struct or a pointer to a
+// struct.
+func (r *Registry) Register(className string, value interface{}) {
+	t := reflect.TypeOf(value)
+
+	structType := t
+	if structType != nil && structType.Kind() == reflect.Ptr {
+		structType = structType.Elem()
+	}
+
+	if structType == nil || structType.Kind() != reflect.Struct {
+		panic(fmt.Sprintf("phpserialize: can not register %T for class %s, "+
+			"it must be a struct or a pointer to a struct", value, className))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.types[registryKey(className)] = t
+	r.names[structType] = strings.TrimPrefix(className, "\\")
+}
+
+// Register registers a Go type with the DefaultRegistry. See Registry.Register.
+func Register(className string, value interface{}) {
+	DefaultRegistry.Register(className, value)
+}
+
+// RegisterCustom registers the function that will decode custom serialized
+// objects ("C:" records) of a PHP class. This is the format used by classes
+// that implement PHP's Serializable interface, such as ArrayObject and
+// SplObjectStorage.
+//
+// Registering the same class name again will replace the existing function.
+func (r *Registry) RegisterCustom(className string, fn CustomUnserializeFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.custom[registryKey(className)] = fn
+}
+
+// RegisterCustom registers a custom object decoder with the DefaultRegistry.
+// See Registry.RegisterCustom.
+func RegisterCustom(className string, fn CustomUnserializeFunc) {
+	DefaultRegistry.RegisterCustom(className, fn)
+}
+
+// RegisterEnum registers the Go values of the cases of a PHP enum. The class
+// name and case name of each value come from its PHPEnumCase method:
+//
+//	registry.RegisterEnum(Hearts, Diamonds, Clubs, Spades)
+//
+// When decoding, an enum case ("E:" record) will be decoded as the Go value
+// registered for it instead of a PHPEnum. A case that is not registered returns
+// an *UnmarshalTypeError. All of the cases of one enum should have the same Go
+// type. Registering cases of the same enum again will replace all of its cases.
+func (r *Registry) RegisterEnum(cases ...EnumCase) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range cases {
+		className, _ := c.PHPEnumCase()
+		delete(r.enums, registryKey(className))
+	}
+
+	for _, c := range cases {
+		className, caseName := c.PHPEnumCase()
+		key := registryKey(className)
+
+		enum, ok := r.enums[key]
+		if !ok {
+			enum = registeredEnum{reflect.TypeOf(c), map[string]EnumCase{}}
+			r.enums[key] = enum
+		}
+
+		enum.cases[caseName] = c
+	}
+}
+
+// RegisterEnum registers the cases of an enum with the DefaultRegistry. See
+// Registry.RegisterEnum.
+func RegisterEnum(cases ...EnumCase) {
+	DefaultRegistry.RegisterEnum(cases...)
+}
+
+func (r *Registry) enumCases(className string) (reflect.Type, map[string]EnumCase) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	enum := r.enums[registryKey(className)]
+
+	return enum.t, enum.cases
+}
+
+func (r *Registry) customFunc(className string) CustomUnserializeFunc {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.custom[registryKey(className)]
+}
+
+func (r *Registry) typeOf(className string) reflect.Type {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.types[registryKey(className)]
+}
+
+// className returns the class name registered for a struct type.
+func (r *Registry) className(t reflect.Type) (string, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	className, ok := r.names[t]
+
+	return className, ok
+}
+
+// registryKey normalises a class name. PHP class names are case-insensitive
+// and a fully qualified name may start with a backslash.
+func registryKey(className string) string {
+	return strings.ToLower(strings.TrimPrefix(className, "\\"))
+}
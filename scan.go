@@ -0,0 +1,215 @@
+package phpserialize
+
+import (
+	"errors"
+	"strconv"
+)
+
+// errUnexpectedEnd is returned by scanValue when the data ends before the
+// value does. Unlike other errors, reading more data may fix it.
+var errUnexpectedEnd = errors.New("unexpected end of data")
+
+// scanValue finds the end of the serialized value that starts at offset
+// without decoding it. It returns the offset after the value and how many
+// numbered values (see decodeState.slots) it contains. The payload of a custom
+// object is opaque, the same as it is for a class that does not have a
+// decoder registered, so the values inside of it are not counted.
+//
+// Unlike the consume functions it does not recurse, so it is safe to use on
+// data of any depth.
+func scanValue(data []byte, offset int) (int, int, error) {
+	s := valueScanner{offset: offset}
+
+	end, err := s.scan(data)
+	if err != nil {
+		return -1, 0, err
+	}
+
+	return end, s.slots, nil
+}
+
+// valueScanner is the state of scanValue. When the data ends part way through
+// the value, scan can be called again with more data and it continues from
+// where it stopped instead of starting again.
+type valueScanner struct {
+	// offset is where the next token starts.
+	offset int
+
+	// remaining holds the number of keys and values that are left to read
+	// in each of the arrays and objects that are open. While it is even the
+	// next item is a key.
+	remaining []int
+
+	// slots is the number of numbered values that have been scanned.
+	slots int
+}
+
+// scan returns the offset after the value. If it returns errUnexpectedEnd the
+// state is left at the start of the token that was not complete. data must
+// start with the same bytes each time scan is called.
+func (s *valueScanner) scan(data []byte) (int, error) {
+	for {
+		offset := s.offset
+		if offset >= len(data) {
+			return -1, errUnexpectedEnd
+		}
+
+		depth := len(s.remaining)
+
+		if depth > 0 && s.remaining[depth-1] == 0 {
+			if data[offset] != '}' {
+				return -1, newSyntaxError(data, offset, `"}"`)
+			}
+
+			s.offset++
+			s.remaining = s.remaining[:depth-1]
+			if len(s.remaining) == 0 {
+				return s.offset, nil
+			}
+
+			continue
+		}
+
+		isKey := depth > 0 && s.remaining[depth-1]%2 == 0
+		token := data[offset]
+
+		// length is the number of elements of an array or properties of
+		// an object, which are only added to remaining once the whole of
+		// the header has been read.
+		length := -1
+
+		var err error
+		switch token {
+		case 'N':
+			offset, err = scanByte(data, offset+1, ';')
+
+		case 'b', 'i', 'd', 'r', 'R':
+			offset, err = scanUntilByte(data, offset, ';')
+
+		case 's', 'E':
+			offset, err = scanString(data, offset+2)
+			if err == nil {
+				offset, err = scanByte(data, offset, ';')
+			}
+
+		case 'a':
+			length, offset, err = scanLength(data, offset+2)
+			if err == nil {
+				offset, err = scanByte(data, offset, '{')
+			}
+
+		case 'O':
+			offset, err = scanString(data, offset+2)
+			if err == nil {
+				offset, err = scanByte(data, offset, ':')
+			}
+			if err == nil {
+				length, offset, err = scanLength(data, offset)
+			}
+			if err == nil {
+				offset, err = scanByte(data, offset, '{')
+			}
+
+		case 'C':
+			var payloadLength int
+			offset, err = scanString(data, offset+2)
+			if err == nil {
+				offset, err = scanByte(data, offset, ':')
+			}
+			if err == nil {
+				payloadLength, offset, err = scanLength(data, offset)
+			}
+			if err == nil {
+				offset, err = scanByte(data, offset, '{')
+			}
+			if err == nil {
+				offset, err = scanByte(data, offset+payloadLength, '}')
+			}
+
+		default:
+			return -1, newSyntaxError(data, offset, "value")
+		}
+
+		if err != nil {
+			return -1, err
+		}
+
+		if depth > 0 {
+			s.remaining[depth-1]--
+		}
+
+		if !isKey && token != 'R' {
+			s.slots++
+		}
+
+		if length >= 0 {
+			s.remaining = append(s.remaining, length*2)
+		}
+
+		s.offset = offset
+		if len(s.remaining) == 0 {
+			return s.offset, nil
+		}
+	}
+}
+
+// scanByte checks that the byte at offset is c and returns the offset after
+// it.
+func scanByte(data []byte, offset int, c byte) (int, error) {
+	// A huge length can overflow the offset.
+	if offset < 0 {
+		return -1, &SyntaxError{Offset: offset, Expected: "length",
+			Found: "invalid length"}
+	}
+
+	if offset >= len(data) {
+		return -1, errUnexpectedEnd
+	}
+
+	if data[offset] != c {
+		return -1, newSyntaxError(data, offset, strconv.Quote(string(c)))
+	}
+
+	return offset + 1, nil
+}
+
+// scanUntilByte returns the offset after the next c.
+func scanUntilByte(data []byte, offset int, c byte) (int, error) {
+	i := findByte(data, c, offset)
+	if i < 0 {
+		return -1, errUnexpectedEnd
+	}
+
+	return i + 1, nil
+}
+
+// scanLength reads a non-negative integer that is followed by a ':'.
+func scanLength(data []byte, offset int) (int, int, error) {
+	end := findByte(data, ':', offset)
+	if end < 0 {
+		return 0, -1, errUnexpectedEnd
+	}
+
+	length, err := strconv.Atoi(string(data[offset:end]))
+	if err != nil || length < 0 {
+		return 0, -1, &SyntaxError{Offset: offset, Expected: "length",
+			Found: strconv.Quote(string(data[offset:end]))}
+	}
+
+	return length, end + 1, nil
+}
+
+// scanString skips over a length and a quoted string, like `3:"foo"`.
+func scanString(data []byte, offset int) (int, error) {
+	length, offset, err := scanLength(data, offset)
+	if err != nil {
+		return -1, err
+	}
+
+	offset, err = scanByte(data, offset, '"')
+	if err != nil {
+		return -1, err
+	}
+
+	return scanByte(data, offset+length, '"')
+}
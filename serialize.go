@@ -2,19 +2,132 @@ package phpserialize
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"reflect"
 	"sort"
 	"strconv"
 	"strings"
 )
 
+// Marshaler is implemented by types that can encode themselves into a PHP
+// serialized value. MarshalPHP must return exactly one complete value, such as
+// "i:123;" or "a:0:{}".
+//
+// The payload of a custom object ("C:") in the returned value is opaque, so
+// any values inside of it are not numbered. Implement CustomSerializer to
+// encode values inside of a payload that references can refer to.
+type Marshaler interface {
+	MarshalPHP() ([]byte, error)
+}
+
+var marshalerType = reflect.TypeOf((*Marshaler)(nil)).Elem()
+
 // MarshalOptions must be provided when invoking Marshal(). Use
 // DefaultMarshalOptions() for sensible defaults.
 type MarshalOptions struct {
 	// If this is true, then all struct names will be stripped from objects
 	// and "stdClass" will be used instead. The default value is false.
 	OnlyStdClass bool
+
+	// If this is true, values are numbered the same way PHP numbers them and
+	// a pointer that has already been encoded is written as a reference
+	// instead of being encoded again. A pointer to a struct becomes an object
+	// reference ("r:N;") and any other pointer becomes a value reference
+	// ("R:N;"). This preserves identity and allows cyclic structures to be
+	// encoded. The default value is false.
+	References bool
+
+	// If this is true, strings are escaped the way that earlier versions of
+	// this package escaped them: single quotes are prefixed with a backslash
+	// and every byte of a []byte is written as a "\xNN" escape sequence. The
+	// length is not adjusted for the escaping so PHP's unserialize() cannot
+	// read these values. DecodePHPString can be used to decode them. The
+	// default value is false, which produces exactly what PHP's serialize()
+	// would.
+	LegacyStringEscaping bool
+
+	// If this is true, map keys are written exactly as they are. The default
+	// value is false, which converts keys the same way PHP does when they are
+	// added to an array: strings that are decimal integers (like "5", but not
+	// "05" or "5.0") become integers, bools become 0 or 1, floats are
+	// truncated to integers and nil becomes "". Keys of any other type return
+	// an error, as do two keys that become the same key.
+	LiteralKeys bool
+
+	// Registry is used to find the PHP class names of structs. Structs that
+	// are not registered use the name of their Go type. The default is nil,
+	// which uses DefaultRegistry. See Registry.Register.
+	Registry *Registry
+}
+
+// encodeState holds everything that must be shared while encoding a single
+// value.
+type encodeState struct {
+	w       encodeWriter
+	options *MarshalOptions
+
+	// n is the number of the last value that was encoded. PHP starts
+	// counting at 1 for the value being encoded. Keys and property names are
+	// not numbered.
+	n int
+
+	// seen holds the number of each pointer that has been encoded. It is
+	// only used when options.References is enabled.
+	seen map[pointerKey]seenPointer
+
+	// marshaled is the first byte of the data returned by the last
+	// Marshaler, such as 'O' or 'a'.
+	marshaled byte
+
+	// visiting contains the pointers and maps that are currently being
+	// encoded so that cycles can be detected.
+	visiting map[pointerKey]bool
+
+	// scratch is used to format numbers without allocating.
+	scratch [64]byte
+}
+
+// encodeWriter is implemented by both *bytes.Buffer and *bufio.Writer. Neither
+// of them return an error from the individual writes (bufio.Writer returns
+// the error when it is flushed) so the errors are not checked.
+type encodeWriter interface {
+	io.Writer
+	io.ByteWriter
+	WriteString(s string) (int, error)
+}
+
+// seenPointer is a pointer that has already been encoded.
+type seenPointer struct {
+	// n is the number of the value that it points to.
+	n int
+
+	// object is true if the value was encoded as a PHP object, which is
+	// referred to with an object reference ("r:N;") rather than a value
+	// reference ("R:N;").
+	object bool
+}
+
+// pointerKey identifies a pointer or map. The type is needed because a pointer
+// to a struct and a pointer to its first field have the same address.
+type pointerKey struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+func newEncodeState(w encodeWriter, options *MarshalOptions) *encodeState {
+	if options == nil {
+		options = DefaultMarshalOptions()
+	}
+
+	return &encodeState{
+		w:        w,
+		options:  options,
+		seen:     map[pointerKey]seenPointer{},
+		visiting: map[pointerKey]bool{},
+	}
 }
 
 // DefaultMarshalOptions will create a new instance of MarshalOptions with
@@ -22,6 +135,10 @@ type MarshalOptions struct {
 func DefaultMarshalOptions() *MarshalOptions {
 	options := new(MarshalOptions)
 	options.OnlyStdClass = false
+	options.References = false
+	options.LegacyStringEscaping = false
+	options.LiteralKeys = false
+	options.Registry = nil
 
 	return options
 }
@@ -58,7 +175,18 @@ func MarshalInt(value int64) []byte {
 
 // MarshalUint is provided for compatibility with unsigned types in Go. It works
 // the same way as MarshalInt.
+//
+// PHP integers are signed 64 bit integers. Values larger than PHP_INT_MAX
+// (math.MaxInt64) are encoded as a float, the same way PHP stores integers
+// that overflow, so they may lose precision:
+//
+//     MarshalUint(math.MaxUint64)
+//     // d:1.8446744073709552E+19;
 func MarshalUint(value uint64) []byte {
+	if value > math.MaxInt64 {
+		return MarshalFloat(float64(value), 64)
+	}
+
 	return []byte("i:" + strconv.FormatUint(value, 10) + ";")
 }
 
@@ -81,8 +209,12 @@ func MarshalUint(value uint64) []byte {
 // The same result would be returned by marshalling a floating-point value:
 //
 //     Marshal(1.23)
+//
+// The float is formatted exactly the same way as PHP 7.1 and later, including
+// large and small numbers ("d:1.0E+25;") and the special values INF, -INF and
+// NAN.
 func MarshalFloat(value float64, bitSize int) []byte {
-	return []byte("d:" + strconv.FormatFloat(value, 'f', -1, bitSize) + ";")
+	return append(appendFloat([]byte("d:"), value, bitSize), ';')
 }
 
 // MarshalString returns the bytes to represent a PHP serialized string value.
@@ -95,14 +227,13 @@ func MarshalFloat(value float64, bitSize int) []byte {
 //
 //     Marshal('Hello world')
 //
+// The string is written exactly as it is. Nothing is escaped and the length is
+// the number of bytes (not characters) in the string.
+//
 // One important distinction is that PHP stores binary data in strings. See
 // MarshalBytes for more information.
 func MarshalString(value string) []byte {
-	// As far as I can tell only the single-quote is escaped. Not even the
-	// backslash itself is escaped. Weird. See escapeTests for more information.
-	value = strings.Replace(value, "'", "\\'", -1)
-
-	return []byte(fmt.Sprintf("s:%d:\"%s\";", len(value), value))
+	return []byte("s:" + strconv.Itoa(len(value)) + ":\"" + value + "\";")
 }
 
 // MarshalBytes returns the bytes to represent a PHP serialized string value
@@ -114,6 +245,20 @@ func MarshalString(value string) []byte {
 // this condition and allow either a string or []byte when unserializing a PHP
 // string.
 func MarshalBytes(value []byte) []byte {
+	return MarshalString(string(value))
+}
+
+// marshalEscapedString is MarshalString with LegacyStringEscaping.
+func marshalEscapedString(value string) []byte {
+	// As far as I can tell only the single-quote is escaped. Not even the
+	// backslash itself is escaped. Weird. See escapeTests for more information.
+	value = strings.Replace(value, "'", "\\'", -1)
+
+	return []byte(fmt.Sprintf("s:%d:\"%s\";", len(value), value))
+}
+
+// marshalEscapedBytes is MarshalBytes with LegacyStringEscaping.
+func marshalEscapedBytes(value []byte) []byte {
 	var buffer bytes.Buffer
 	for _, c := range value {
 		buffer.WriteString(fmt.Sprintf("\\x%02x", c))
@@ -140,174 +285,558 @@ func MarshalNil() []byte {
 // Fields that are not exported (starting with a lowercase letter) will not be
 // present in the output. All fields that appear in the output will have their
 // first letter converted to lowercase. Any other uppercase letters in the field
-// name are maintained. At the moment there is no way to change this behaviour,
-// unlike other marshallers that use a tag on the field.
+// name are maintained. The name can be changed with a tag on the field:
+//
+//     Name string `php:"name"`
+//
+// Fields are public properties unless they have the "protected" or "private"
+// tag option. The names of these properties are mangled the same way PHP does
+// it, using the class name of the struct for private properties:
+//
+//     Secret string `php:"secret,private"`
+//
+// The class name is the name of the Go type, unless a different class name was
+// registered for the type with Registry.Register.
 func MarshalStruct(input interface{}, options *MarshalOptions) ([]byte, error) {
-	value := reflect.ValueOf(input)
-	typeOfValue := value.Type()
+	var buffer bytes.Buffer
+	e := newEncodeState(&buffer, options)
+	e.n++
 
-	// Some of the fields in the struct may not be visible (unexported). We
-	// need to make sure we count all the visible ones for the final result.
-	visibleFieldCount := 0
+	err := e.marshalStruct(reflect.Indirect(reflect.ValueOf(input)))
+	if err != nil {
+		return nil, err
+	}
 
-	var buffer bytes.Buffer
-	for i := 0; i < value.NumField(); i++ {
-		f := value.Field(i)
+	return buffer.Bytes(), nil
+}
 
-		if !f.CanInterface() {
-			// This is an unexported field, we cannot read it.
-			continue
-		}
+func (e *encodeState) registry() *Registry {
+	if e.options.Registry != nil {
+		return e.options.Registry
+	}
+
+	return DefaultRegistry
+}
+
+// className returns the PHP class name for the struct type t.
+func (e *encodeState) className(t reflect.Type) string {
+	if e.options.OnlyStdClass {
+		return "stdClass"
+	}
 
-		visibleFieldCount++
+	if registered, ok := e.registry().className(t); ok {
+		return registered
+	}
 
-		fieldName, fieldOptions := parseTag(typeOfValue.Field(i).Tag.Get("php"))
+	return t.Name()
+}
 
-		if fieldOptions.Contains("omitnilptr") {
+func (e *encodeState) marshalStruct(value reflect.Value) error {
+	className := e.className(value.Type())
+
+	// Some of the fields in the struct may be omitted, or inside of an
+	// embedded pointer that is nil. The number of properties is written
+	// before any of them so we need to find all of the visible ones first.
+	var fields []structField
+	var values []reflect.Value
+	for _, field := range structFields(value.Type()) {
+		f, ok := fieldByIndex(value, field.index)
+		if !ok {
+			continue
+		}
+
+		if field.options.Contains("omitnilptr") {
 			if f.Kind() == reflect.Ptr && f.IsNil() {
-				visibleFieldCount--
 				continue
 			}
 		}
 
-		if fieldName == "-" {
-			visibleFieldCount--
-			continue
-		} else if fieldName == "" {
-			fieldName = lowerCaseFirstLetter(typeOfValue.Field(i).Name)
+		fields = append(fields, field)
+		values = append(values, f)
+	}
+
+	e.writeObjectHeader(className, len(fields))
+
+	for i, field := range fields {
+		// Private properties of an embedded struct belong to its class,
+		// the same as a private property of a parent class in PHP.
+		declaredIn := className
+		if field.declaredIn != value.Type() {
+			declaredIn = e.className(field.declaredIn)
 		}
-		buffer.Write(MarshalString(fieldName))
 
-		m, err := Marshal(f.Interface(), options)
+		e.writeString(MangledPropertyName(declaredIn, field.name,
+			field.options.visibility()))
+
+		err := e.marshal(values[i].Interface())
 		if err != nil {
-			return nil, err
+			return err
 		}
-
-		buffer.Write(m)
 	}
 
-	className := reflect.ValueOf(input).Type().Name()
-	if options.OnlyStdClass {
-		className = "stdClass"
-	}
+	e.w.WriteByte('}')
 
-	return []byte(fmt.Sprintf("O:%d:\"%s\":%d:{%s}", len(className),
-		className, visibleFieldCount, buffer.String())), nil
+	return nil
 }
 
 // Marshal is the canonical way to perform the equivalent of serialize() in PHP.
 // It can handle encoding scalar types, slices and maps.
 func Marshal(input interface{}, options *MarshalOptions) ([]byte, error) {
+	var buffer bytes.Buffer
 
-	if options == nil {
-		options = DefaultMarshalOptions()
+	err := newEncodeState(&buffer, options).marshal(input)
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// marshal encodes a value that will be numbered. This is every value except
+// for keys.
+func (e *encodeState) marshal(input interface{}) error {
+	e.n++
+
+	return e.marshalValue(input)
+}
+
+func (e *encodeState) marshalValue(input interface{}) error {
+	// Pointers are handled first so that they can be tracked as references
+	// even when they implement Marshaler or CustomSerializer.
+	if input != nil && reflect.ValueOf(input).Kind() == reflect.Ptr {
+		return e.marshalPointer(reflect.ValueOf(input))
+	}
+
+	if m, ok := asMarshaler(input); ok {
+		return e.marshalMarshaler(m)
+	}
+
+	if c, ok := input.(CustomSerializer); ok {
+		return e.marshalCustom(c)
+	}
+
+	if c, ok := input.(EnumCase); ok {
+		return e.marshalEnum(c)
+	}
+
+	switch o := input.(type) {
+	case PHPObject:
+		return e.marshalProperties(o.ClassName, o.Properties)
+
+	case PHPIncompleteClass:
+		return e.marshalProperties(o.ClassName, o.Properties)
+
+	case OrderedArray:
+		return e.marshalOrderedArray(o)
 	}
 
 	// []byte is a special case because all strings (binary and otherwise)
 	// are handled as strings in PHP.
 	if bytesToEncode, ok := input.([]byte); ok {
-		return MarshalBytes(bytesToEncode), nil
+		if e.options.LegacyStringEscaping {
+			e.w.Write(marshalEscapedBytes(bytesToEncode))
+		} else {
+			e.writeString(string(bytesToEncode))
+		}
+
+		return nil
 	}
 
 	// Nil is another special case because it is typeless and must be
 	// handled before trying to determine the type.
 	if input == nil {
-		return MarshalNil(), nil
+		e.w.WriteString("N;")
+		return nil
 	}
 
 	// Otherwise we need to decide if it is a scalar value, map or slice.
 	value := reflect.ValueOf(input)
 	switch value.Kind() {
 	case reflect.Bool:
-		return MarshalBool(value.Bool()), nil
+		e.w.Write(MarshalBool(value.Bool()))
 
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
 		reflect.Int64:
-		return MarshalInt(value.Int()), nil
+		e.writeInt(value.Int())
 
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		return MarshalUint(value.Uint()), nil
+		e.writeUint(value.Uint())
 
 	case reflect.Float32:
-		return MarshalFloat(value.Float(), 32), nil
+		e.writeFloat(value.Float(), 32)
 
 	case reflect.Float64:
-		return MarshalFloat(value.Float(), 64), nil
+		e.writeFloat(value.Float(), 64)
 
 	case reflect.String:
-		return MarshalString(value.String()), nil
+		if e.options.LegacyStringEscaping {
+			e.w.Write(marshalEscapedString(value.String()))
+		} else {
+			e.writeString(value.String())
+		}
 
 	case reflect.Slice:
-		return marshalSlice(value.Interface(), options)
+		return e.marshalSlice(value)
 
 	case reflect.Map:
-		return marshalMap(value.Interface(), options)
+		return e.marshalMap(value)
 
 	case reflect.Struct:
-		return MarshalStruct(input, options)
+		return e.marshalStruct(value)
 
-	case reflect.Ptr:
-		if value.IsNil() {
-			return MarshalNil(), nil
+	default:
+		return fmt.Errorf("can not encode: %T", input)
+	}
+
+	return nil
+}
+
+// marshalPointer encodes the value that a pointer points to, or a reference to
+// it if it has been encoded before.
+func (e *encodeState) marshalPointer(value reflect.Value) error {
+	if value.IsNil() {
+		e.w.WriteString("N;")
+		return nil
+	}
+
+	key := pointerKey{value.Pointer(), value.Type()}
+
+	if e.options.References {
+		if seen, ok := e.seen[key]; ok {
+			if seen.object {
+				e.w.WriteString("r:")
+			} else {
+				// Unlike object references, value references are
+				// not numbered themselves.
+				e.n--
+				e.w.WriteString("R:")
+			}
+
+			e.w.Write(strconv.AppendInt(e.scratch[:0], int64(seen.n), 10))
+			e.w.WriteByte(';')
+
+			return nil
 		}
-		return Marshal(value.Elem().Interface(), options)
 
-	default:
-		return nil, fmt.Errorf("can not encode: %T", input)
+		e.seen[key] = seenPointer{e.n, isObject(value)}
+	}
+
+	if e.visiting[key] {
+		return fmt.Errorf("can not encode cyclic value: %s", value.Type())
 	}
+
+	e.visiting[key] = true
+	defer delete(e.visiting, key)
+
+	if m, ok := value.Interface().(Marshaler); ok {
+		return e.marshalReferencedMarshaler(key, m)
+	}
+
+	if c, ok := value.Interface().(CustomSerializer); ok {
+		return e.marshalCustom(c)
+	}
+
+	if c, ok := value.Interface().(EnumCase); ok {
+		return e.marshalEnum(c)
+	}
+
+	if m, ok := asMarshaler(value.Elem().Interface()); ok {
+		return e.marshalReferencedMarshaler(key, m)
+	}
+
+	return e.marshalValue(value.Elem().Interface())
 }
 
-func marshalSlice(input interface{}, options *MarshalOptions) ([]byte, error) {
-	s := reflect.ValueOf(input)
+// isObject returns true if the value that ptr points to is encoded as a PHP
+// object. Structs are objects, except for an OrderedArray which is an array.
+// Values from a Marshaler can be anything, so they are checked once they have
+// been encoded.
+func isObject(ptr reflect.Value) bool {
+	if _, ok := ptr.Interface().(CustomSerializer); ok {
+		return true
+	}
+
+	elem := ptr.Elem()
+
+	return elem.Kind() == reflect.Struct && elem.Type() != orderedArrayType
+}
+
+// marshalReferencedMarshaler encodes the value of a pointer with a Marshaler
+// and records whether it was an object, so that later references to the
+// pointer are the right kind.
+func (e *encodeState) marshalReferencedMarshaler(key pointerKey,
+	m Marshaler) error {
+	err := e.marshalMarshaler(m)
+	if err != nil {
+		return err
+	}
+
+	if seen, ok := e.seen[key]; ok {
+		seen.object = e.marshaled == 'O' || e.marshaled == 'C'
+		e.seen[key] = seen
+	}
+
+	return nil
+}
+
+// asMarshaler returns the Marshaler for a value that is not a pointer. If only
+// a pointer to the type implements Marshaler then it is called on a copy of
+// the value.
+func asMarshaler(input interface{}) (Marshaler, bool) {
+	if m, ok := input.(Marshaler); ok {
+		return m, true
+	}
+
+	value := reflect.ValueOf(input)
+	if !value.IsValid() || !reflect.PtrTo(value.Type()).Implements(marshalerType) {
+		return nil, false
+	}
+
+	ptr := reflect.New(value.Type())
+	ptr.Elem().Set(value)
+
+	return ptr.Interface().(Marshaler), true
+}
+
+func (e *encodeState) marshalMarshaler(m Marshaler) error {
+	data, err := m.MarshalPHP()
+	if err != nil {
+		return err
+	}
+
+	// The value must be checked, otherwise it could corrupt everything
+	// around it. This also finds how many values it contains so that the
+	// numbering of any references after it are still correct.
+	end, slots, err := scanValue(data, 0)
+	if err == nil && end != len(data) {
+		err = errors.New("unexpected data after value")
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value from MarshalPHP of %T: %s", m, err)
+	}
+
+	// The value itself has already been counted.
+	e.n += slots - 1
+	e.marshaled = data[0]
+	e.w.Write(data)
+
+	return nil
+}
+
+func (e *encodeState) marshalSlice(s reflect.Value) error {
+	e.writeArrayHeader(s.Len())
 
-	var buffer bytes.Buffer
 	for i := 0; i < s.Len(); i++ {
-		m, err := Marshal(i, options)
+		e.writeInt(int64(i))
+
+		err := e.marshal(s.Index(i).Interface())
 		if err != nil {
-			return nil, err
+			return err
 		}
+	}
 
-		buffer.Write(m)
+	e.w.WriteByte('}')
 
-		m, err = Marshal(s.Index(i).Interface(), options)
-		if err != nil {
-			return nil, err
+	return nil
+}
+
+func (e *encodeState) marshalMap(s reflect.Value) error {
+	// A map can contain itself when its values are interface{}.
+	if !s.IsNil() {
+		key := pointerKey{s.Pointer(), s.Type()}
+		if e.visiting[key] {
+			return fmt.Errorf("can not encode cyclic value: %s", s.Type())
 		}
 
-		buffer.Write(m)
+		e.visiting[key] = true
+		defer delete(e.visiting, key)
 	}
 
-	return []byte(fmt.Sprintf("a:%d:{%s}", s.Len(), buffer.String())), nil
-}
+	mapKeys := s.MapKeys()
+	keys := make([]reflect.Value, len(mapKeys))
+	values := map[interface{}]reflect.Value{}
+	for i, mapKey := range mapKeys {
+		key, err := e.arrayKey(mapKey)
+		if err != nil {
+			return err
+		}
 
-func marshalMap(input interface{}, options *MarshalOptions) ([]byte, error) {
-	s := reflect.ValueOf(input)
+		if !e.options.LiteralKeys {
+			if _, ok := values[key.Interface()]; ok {
+				return fmt.Errorf("duplicate array key %v in %s",
+					key.Interface(), s.Type())
+			}
+
+			values[key.Interface()] = s.MapIndex(mapKey)
+		}
+
+		keys[i] = key
+		mapKeys[i] = s.MapIndex(mapKey)
+	}
 
 	// Go randomises maps. To be able to test this we need to make sure the
 	// map keys always come out in the same order. So we sort them first.
-	mapKeys := s.MapKeys()
-	sort.Slice(mapKeys, func(i, j int) bool {
-		return lessValue(mapKeys[i], mapKeys[j])
-	})
+	sort.Sort(byKey{keys, mapKeys})
 
-	var buffer bytes.Buffer
-	for _, mapKey := range mapKeys {
-		m, err := Marshal(mapKey.Interface(), options)
+	e.writeArrayHeader(len(keys))
+
+	for i, key := range keys {
+		err := e.marshalValue(key.Interface())
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		buffer.Write(m)
-
-		m, err = Marshal(s.MapIndex(mapKey).Interface(), options)
+		err = e.marshal(mapKeys[i].Interface())
 		if err != nil {
-			return nil, err
+			return err
+		}
+	}
+
+	e.w.WriteByte('}')
+
+	return nil
+}
+
+// byKey sorts the keys of a map along with their values.
+type byKey struct {
+	keys, values []reflect.Value
+}
+
+func (b byKey) Len() int {
+	return len(b.keys)
+}
+
+func (b byKey) Less(i, j int) bool {
+	return lessValue(b.keys[i], b.keys[j])
+}
+
+func (b byKey) Swap(i, j int) {
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+	b.values[i], b.values[j] = b.values[j], b.values[i]
+}
+
+// arrayKey converts a map key into the key that PHP would use, unless the
+// LiteralKeys option is enabled. The result is either an int64 or a string.
+func (e *encodeState) arrayKey(key reflect.Value) (reflect.Value, error) {
+	if key.IsValid() && e.options.LiteralKeys {
+		return key, nil
+	}
+
+	return phpArrayKey(key)
+}
+
+// phpArrayKey converts a key into the int64 or string key that PHP would use.
+func phpArrayKey(key reflect.Value) (reflect.Value, error) {
+	if key.Kind() == reflect.Interface {
+		key = key.Elem()
+	}
+
+	// PHP uses an empty string for a null key.
+	if !key.IsValid() {
+		return reflect.ValueOf(""), nil
+	}
+
+	switch key.Kind() {
+	case reflect.String:
+		if i, ok := integerKey(key.String()); ok {
+			return reflect.ValueOf(i), nil
+		}
+
+		return reflect.ValueOf(key.String()), nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return reflect.ValueOf(key.Int()), nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if key.Uint() <= math.MaxInt64 {
+			return reflect.ValueOf(int64(key.Uint())), nil
+		}
+
+	case reflect.Bool:
+		if key.Bool() {
+			return reflect.ValueOf(int64(1)), nil
+		}
+
+		return reflect.ValueOf(int64(0)), nil
+
+	case reflect.Float32, reflect.Float64:
+		// PHP truncates floats. Floats that do not fit in an integer are
+		// not valid keys.
+		f := math.Trunc(key.Float())
+		if f >= math.MinInt64 && f < math.MaxInt64 {
+			return reflect.ValueOf(int64(f)), nil
 		}
+	}
+
+	return reflect.Value{}, fmt.Errorf("can not use %s as an array key: %v",
+		key.Type(), key.Interface())
+}
 
-		buffer.Write(m)
+// integerKey returns the integer that PHP would use for a string key. Only
+// strings that are exactly how the integer would be formatted are converted.
+func integerKey(s string) (int64, bool) {
+	if s == "" || len(s) > 20 {
+		return 0, false
 	}
 
-	return []byte(fmt.Sprintf("a:%d:{%s}", s.Len(), buffer.String())), nil
+	i, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(i, 10) != s {
+		return 0, false
+	}
+
+	return i, true
+}
+
+// writeArrayHeader writes the start of an array, up to and including the '{'.
+func (e *encodeState) writeArrayHeader(length int) {
+	e.w.WriteString("a:")
+	e.w.Write(strconv.AppendInt(e.scratch[:0], int64(length), 10))
+	e.w.WriteString(":{")
+}
+
+// writeObjectHeader writes the start of an object, up to and including the
+// '{'.
+func (e *encodeState) writeObjectHeader(className string, length int) {
+	e.w.WriteString("O:")
+	e.w.Write(strconv.AppendInt(e.scratch[:0], int64(len(className)), 10))
+	e.w.WriteString(":\"")
+	e.w.WriteString(className)
+	e.w.WriteString("\":")
+	e.w.Write(strconv.AppendInt(e.scratch[:0], int64(length), 10))
+	e.w.WriteString(":{")
+}
+
+// writeInt is the same as MarshalInt.
+func (e *encodeState) writeInt(value int64) {
+	e.w.WriteString("i:")
+	e.w.Write(strconv.AppendInt(e.scratch[:0], value, 10))
+	e.w.WriteByte(';')
+}
+
+// writeUint is the same as MarshalUint.
+func (e *encodeState) writeUint(value uint64) {
+	if value > math.MaxInt64 {
+		e.writeFloat(float64(value), 64)
+		return
+	}
+
+	e.writeInt(int64(value))
+}
+
+// writeFloat is the same as MarshalFloat.
+func (e *encodeState) writeFloat(value float64, bitSize int) {
+	e.w.WriteString("d:")
+	e.w.Write(appendFloat(e.scratch[:0], value, bitSize))
+	e.w.WriteByte(';')
+}
+
+// writeString is the same as MarshalString.
+func (e *encodeState) writeString(value string) {
+	e.w.WriteString("s:")
+	e.w.Write(strconv.AppendInt(e.scratch[:0], int64(len(value)), 10))
+	e.w.WriteString(":\"")
+	e.w.WriteString(value)
+	e.w.WriteString("\";")
 }
 
 func lowerCaseFirstLetter(s string) string {
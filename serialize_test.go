@@ -1,8 +1,12 @@
 package phpserialize_test
 
 import (
+	"errors"
+	"fmt"
 	"github.com/elliotchance/phpserialize"
+	"math"
 	"reflect"
+	"strconv"
 	"testing"
 )
 
@@ -26,6 +30,53 @@ type structTag struct {
 	Nilptr  *Struct2 `php:",omitnilptr"`
 }
 
+type structVisibility struct {
+	Public    string
+	Protected int    `php:"prot,protected"`
+	Private   string `php:",private"`
+}
+
+// money is an amount in cents that PHP stores as a decimal string.
+type money int64
+
+func (m money) MarshalPHP() ([]byte, error) {
+	return phpserialize.MarshalString(fmt.Sprintf("%d.%02d", m/100, m%100)), nil
+}
+
+func (m *money) UnmarshalPHP(data []byte) error {
+	s, err := phpserialize.UnmarshalString(data)
+	if err != nil {
+		return err
+	}
+
+	f, err := strconv.ParseFloat(s, 64)
+	*m = money(f*100 + 0.5)
+
+	return err
+}
+
+// point only implements Marshaler on its pointer.
+type point struct {
+	X, Y int64
+}
+
+func (p *point) MarshalPHP() ([]byte, error) {
+	return []byte(fmt.Sprintf("a:2:{i:0;i:%d;i:1;i:%d;}", p.X, p.Y)), nil
+}
+
+type badMarshaler struct{}
+
+func (badMarshaler) MarshalPHP() ([]byte, error) {
+	return []byte("i:1"), nil
+}
+
+type marshalerHolder struct {
+	Price    money
+	Prices   []money
+	Location point
+	Nearby   *point
+}
+
 type Struct2 struct {
 	Qux float64
 }
@@ -57,6 +108,13 @@ func getStdClassOnly() *phpserialize.MarshalOptions {
 	return stdClassOnly
 }
 
+func getLegacyStringEscaping() *phpserialize.MarshalOptions {
+	legacyStringEscaping := phpserialize.DefaultMarshalOptions()
+	legacyStringEscaping.LegacyStringEscaping = true
+
+	return legacyStringEscaping
+}
+
 // These tests have been adapted from the wonderful work at:
 // https://github.com/mitsuhiko/phpserialize/blob/master/tests.py
 var marshalTests = map[string]marshalTest{
@@ -82,6 +140,12 @@ var marshalTests = map[string]marshalTest{
 	"uint16: 7":  {uint16(7), []byte("i:7;"), nil},
 	"uint32: 9":  {uint32(9), []byte("i:9;"), nil},
 	"uint64: 11": {uint64(11), []byte("i:11;"), nil},
+	"uint64: PHP_INT_MAX": {uint64(math.MaxInt64),
+		[]byte("i:9223372036854775807;"), nil},
+	"uint64: PHP_INT_MAX+1": {uint64(math.MaxInt64 + 1),
+		[]byte("d:9.223372036854776E+18;"), nil},
+	"uint64: max": {uint64(math.MaxUint64),
+		[]byte("d:1.8446744073709552E+19;"), nil},
 
 	// encode float
 	"float64: 3.2":        {3.2, []byte("d:3.2;"), nil},
@@ -107,8 +171,18 @@ var marshalTests = map[string]marshalTest{
 
 	// encode binary
 	"[]byte: \\001\\002\\003": {
+		[]byte{1, 2, 3},
+		[]byte("s:3:\"\x01\x02\x03\";"),
+		nil,
+	},
+	"[]byte: \\001\\002\\003: LegacyStringEscaping = true": {
 		[]byte{1, 2, 3},
 		[]byte("s:3:\"\\x01\\x02\\x03\";"),
+		getLegacyStringEscaping(),
+	},
+	"[]byte: quotes and null bytes": {
+		[]byte("a\"b'c\x00d"),
+		[]byte("s:7:\"a\"b'c\x00d\";"),
 		nil,
 	},
 
@@ -167,6 +241,18 @@ var marshalTests = map[string]marshalTest{
 		nil,
 	},
 
+	// encode object (struct with protected and private properties)
+	"structVisibility{Public string, Protected int, Private string}": {
+		structVisibility{"a", 1, "b"},
+		[]byte("O:16:\"structVisibility\":3:{s:6:\"public\";s:1:\"a\";s:7:\"\x00*\x00prot\";i:1;s:25:\"\x00structVisibility\x00private\";s:1:\"b\";}"),
+		nil,
+	},
+	"structVisibility{Public string, Protected int, Private string}: OnlyStdClass = true": {
+		structVisibility{"a", 1, "b"},
+		[]byte("O:8:\"stdClass\":3:{s:6:\"public\";s:1:\"a\";s:7:\"\x00*\x00prot\";i:1;s:17:\"\x00stdClass\x00private\";s:1:\"b\";}"),
+		getStdClassOnly(),
+	},
+
 	// stdClassOnly
 	"struct1{Foo int, Bar Struct2{Qux float64}, hidden bool}: OnlyStdClass = true": {
 		struct1{10, Struct2{1.23}, true, "yay"},
@@ -239,3 +325,266 @@ func TestMarshalEscape(t *testing.T) {
 		})
 	}
 }
+
+type linkedNode struct {
+	Value int
+	Next  *linkedNode
+}
+
+func getReferences() *phpserialize.MarshalOptions {
+	references := phpserialize.DefaultMarshalOptions()
+	references.References = true
+
+	return references
+}
+
+func TestMarshalReferences(t *testing.T) {
+	shared := &Struct2{1.5}
+	sharedInt := 5
+	cyclic := &linkedNode{Value: 1}
+	cyclic.Next = &linkedNode{Value: 2, Next: cyclic}
+
+	tests := map[string]marshalTest{
+		"shared pointer without references": {
+			[]*Struct2{shared, shared},
+			[]byte(`a:2:{i:0;O:7:"Struct2":1:{s:3:"qux";d:1.5;}i:1;O:7:"Struct2":1:{s:3:"qux";d:1.5;}}`),
+			nil,
+		},
+		"shared pointer": {
+			[]*Struct2{shared, shared},
+			[]byte(`a:2:{i:0;O:7:"Struct2":1:{s:3:"qux";d:1.5;}i:1;r:2;}`),
+			getReferences(),
+		},
+		"shared pointer in struct": {
+			referenceHolder{A: shared, B: shared},
+			[]byte(`O:15:"referenceHolder":3:{s:1:"a";O:7:"Struct2":1:{s:3:"qux";d:1.5;}s:1:"b";r:2;s:1:"c";O:7:"Struct2":1:{s:3:"qux";d:0;}}`),
+			getReferences(),
+		},
+		"shared value pointer": {
+			[]interface{}{&sharedInt, &sharedInt, "foo", &sharedInt},
+			[]byte(`a:4:{i:0;i:5;i:1;R:2;i:2;s:3:"foo";i:3;R:2;}`),
+			getReferences(),
+		},
+		"object references are numbered": {
+			[]interface{}{shared, shared, &sharedInt, shared, &sharedInt},
+			[]byte(`a:5:{i:0;O:7:"Struct2":1:{s:3:"qux";d:1.5;}i:1;r:2;i:2;i:5;i:3;r:2;i:4;R:5;}`),
+			getReferences(),
+		},
+		"cycle": {
+			cyclic,
+			[]byte(`O:10:"linkedNode":2:{s:5:"value";i:1;s:4:"next";O:10:"linkedNode":2:{s:5:"value";i:2;s:4:"next";r:1;}}`),
+			getReferences(),
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			result, err := phpserialize.Marshal(test.input, test.options)
+			expectErrorToNotHaveOccurred(t, err)
+
+			if !reflect.DeepEqual(result, test.output) {
+				t.Errorf("Expected '%v', got '%v'", string(test.output),
+					string(result))
+			}
+		})
+	}
+}
+
+func TestMarshalReferencesRoundTrip(t *testing.T) {
+	input := &linkedNode{Value: 1}
+	input.Next = &linkedNode{Value: 2, Next: input}
+
+	data, err := phpserialize.Marshal(input, getReferences())
+	expectErrorToNotHaveOccurred(t, err)
+
+	var result linkedNode
+	err = phpserialize.Unmarshal(data, &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if result.Value != 1 || result.Next.Value != 2 || result.Next.Next != &result {
+		t.Errorf("Unexpected value: %#+v", result)
+	}
+}
+
+func TestMarshalCycleWithoutReferences(t *testing.T) {
+	input := &linkedNode{Value: 1}
+	input.Next = input
+
+	_, err := phpserialize.Marshal(input, nil)
+	expectErrorToEqual(t, err,
+		errors.New("can not encode cyclic value: *phpserialize_test.linkedNode"))
+}
+
+func TestMarshalLegacyEscape(t *testing.T) {
+	tests := map[string]struct {
+		Unserialized, Serialized string
+	}{
+		"SingleQuote": {
+			"foo'bar", `s:8:"foo\'bar";`,
+		},
+		"Backslash": {
+			"foo\\bar", `s:7:"foo\bar";`,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			result, err := phpserialize.Marshal(test.Unserialized,
+				getLegacyStringEscaping())
+			expectErrorToNotHaveOccurred(t, err)
+
+			if test.Serialized != string(result) {
+				t.Errorf("Expected:\n  %#+v\nGot:\n  %#+v", test.Serialized, string(result))
+			}
+
+			// DecodePHPString is able to undo the escaping.
+			var decoded string
+			err = phpserialize.Unmarshal(result, &decoded)
+			expectErrorToNotHaveOccurred(t, err)
+
+			if test.Unserialized != phpserialize.DecodePHPString([]byte(decoded)) {
+				t.Errorf("Expected %q, got %q", test.Unserialized, decoded)
+			}
+		})
+	}
+}
+
+func TestMarshalArrayKeys(t *testing.T) {
+	tests := map[string]marshalTest{
+		"IntegerStrings": {
+			map[string]int{"10": 1, "9": 2, "-3": 3},
+			[]byte(`a:3:{i:-3;i:3;i:9;i:2;i:10;i:1;}`),
+			nil,
+		},
+		"NonCanonicalStrings": {
+			map[string]int{"05": 1, "-0": 2, "+5": 3, "5.0": 4, " 5": 5,
+				"9223372036854775808": 6},
+			[]byte(`a:6:{s:2:" 5";i:5;s:2:"+5";i:3;s:2:"-0";i:2;s:2:"05";i:1;` +
+				`s:3:"5.0";i:4;s:19:"9223372036854775808";i:6;}`),
+			nil,
+		},
+		"Bools": {
+			map[bool]string{true: "a", false: "b"},
+			[]byte(`a:2:{i:0;s:1:"b";i:1;s:1:"a";}`),
+			nil,
+		},
+		"Floats": {
+			map[float64]string{1.9: "a", -2.5: "b"},
+			[]byte(`a:2:{i:-2;s:1:"b";i:1;s:1:"a";}`),
+			nil,
+		},
+		"Interfaces": {
+			map[interface{}]int{nil: 1, "1": 2, uint8(2): 3},
+			[]byte(`a:3:{i:1;i:2;i:2;i:3;s:0:"";i:1;}`),
+			nil,
+		},
+		"OrderedArray": {
+			phpserialize.OrderedArray{Elements: []phpserialize.ArrayElement{
+				{"1", "a"}, {false, "b"}, {nil, "c"},
+			}},
+			[]byte(`a:3:{i:1;s:1:"a";i:0;s:1:"b";s:0:"";s:1:"c";}`),
+			nil,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			result, err := phpserialize.Marshal(test.input, nil)
+			expectErrorToNotHaveOccurred(t, err)
+
+			if string(result) != string(test.output) {
+				t.Errorf("Expected %q, got %q", test.output, result)
+			}
+		})
+	}
+}
+
+func TestMarshalLiteralKeys(t *testing.T) {
+	options := phpserialize.DefaultMarshalOptions()
+	options.LiteralKeys = true
+
+	result, err := phpserialize.Marshal(map[string]int{"5": 1}, options)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := `a:1:{s:1:"5";i:1;}`
+	if string(result) != expected {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+}
+
+func TestMarshalInvalidArrayKeys(t *testing.T) {
+	tests := map[string]struct {
+		input interface{}
+		err   string
+	}{
+		"Struct": {
+			map[Struct2]int{{}: 1},
+			"can not use phpserialize_test.Struct2 as an array key: {0}",
+		},
+		"Infinity": {
+			map[float64]int{math.Inf(1): 1},
+			"can not use float64 as an array key: +Inf",
+		},
+		"Duplicate": {
+			map[interface{}]int{"5": 1, 5: 2},
+			"duplicate array key 5 in map[interface {}]int",
+		},
+		"DuplicateOrderedArray": {
+			phpserialize.OrderedArray{Elements: []phpserialize.ArrayElement{
+				{Key: "5", Value: 1},
+				{Key: int64(5), Value: 2},
+			}},
+			"duplicate array key 5 in phpserialize.OrderedArray",
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			_, err := phpserialize.Marshal(test.input, nil)
+			expectErrorToEqual(t, err, errors.New(test.err))
+		})
+	}
+}
+
+func TestMarshalMarshaler(t *testing.T) {
+	input := marshalerHolder{
+		Price:    1234,
+		Prices:   []money{5, 600},
+		Location: point{1, 2},
+		Nearby:   &point{3, 4},
+	}
+
+	result, err := phpserialize.Marshal(input, nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := `O:15:"marshalerHolder":4:{` +
+		`s:5:"price";s:5:"12.34";` +
+		`s:6:"prices";a:2:{i:0;s:4:"0.05";i:1;s:4:"6.00";}` +
+		`s:8:"location";a:2:{i:0;i:1;i:1;i:2;}` +
+		`s:6:"nearby";a:2:{i:0;i:3;i:1;i:4;}}`
+	if string(result) != expected {
+		t.Errorf("Expected:\n  %s\nGot:\n  %s", expected, result)
+	}
+}
+
+func TestMarshalMarshalerReferenceNumbering(t *testing.T) {
+	s := &Struct2{Qux: 1.5}
+	input := []interface{}{&point{1, 2}, s, s}
+
+	result, err := phpserialize.Marshal(input, getReferences())
+	expectErrorToNotHaveOccurred(t, err)
+
+	// The array is 1, the point is 2 to 4 and the object is 5.
+	expected := `a:3:{i:0;a:2:{i:0;i:1;i:1;i:2;}` +
+		`i:1;O:7:"Struct2":1:{s:3:"qux";d:1.5;}i:2;r:5;}`
+	if string(result) != expected {
+		t.Errorf("Expected:\n  %s\nGot:\n  %s", expected, result)
+	}
+}
+
+func TestMarshalInvalidMarshaler(t *testing.T) {
+	_, err := phpserialize.Marshal([]interface{}{badMarshaler{}}, nil)
+	expectErrorToEqual(t, err, errors.New(
+		"invalid value from MarshalPHP of phpserialize_test.badMarshaler: "+
+			"unexpected end of data"))
+}
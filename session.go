@@ -0,0 +1,343 @@
+package phpserialize
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// SessionHandler is the format of PHP session data. It is chosen in PHP with
+// the session.serialize_handler setting.
+type SessionHandler int
+
+const (
+	// SessionPHP is the "php" handler, which is the default in PHP. Each
+	// variable is written as its name, a "|" and its serialized value:
+	//
+	//     name|s:3:"Bob";visits|i:3;
+	SessionPHP SessionHandler = iota
+
+	// SessionPHPBinary is the "php_binary" handler. Each variable is written
+	// as a single byte with the length of its name, the name and its
+	// serialized value. Names can not be longer than 127 bytes. If the high
+	// bit of the length is set the variable is undefined and has no value.
+	// Undefined variables are skipped when decoding.
+	SessionPHPBinary
+
+	// SessionPHPSerialize is the "php_serialize" handler. The session is
+	// serialized as a single array:
+	//
+	//     a:2:{s:4:"name";s:3:"Bob";s:6:"visits";i:3;}
+	SessionPHPSerialize
+)
+
+// maxBinaryNameLength is the longest variable name that the php_binary handler
+// can write. The high bit of the length is not part of the length.
+const maxBinaryNameLength = 127
+
+// binaryUndefined is the high bit of the length of a variable name written by
+// the php_binary handler (PS_BIN_UNDEF in PHP). It means that the variable is
+// undefined, so no value follows the name.
+const binaryUndefined = 0x80
+
+// DecodeSession decodes PHP session data that was written by handler into the
+// map or struct pointed to by v. If options is nil DefaultDecodeOptions() is
+// used.
+//
+// The variables are decoded the same way as the elements of an array are
+// decoded into a map, or the properties of an object into a struct. References
+// can refer to values in other variables, the same as they can in PHP.
+func DecodeSession(data []byte, v interface{}, handler SessionHandler,
+	options *DecodeOptions) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+
+	value := rv.Elem()
+	if value.Kind() != reflect.Map && value.Kind() != reflect.Struct {
+		return &UnmarshalTypeError{
+			Value:  "session",
+			Type:   value.Type(),
+			Offset: 0,
+			Path:   "$",
+		}
+	}
+
+	switch handler {
+	case SessionPHP, SessionPHPBinary:
+		return newDecodeState(data, options).fillSession(value, handler)
+
+	case SessionPHPSerialize:
+		return UnmarshalWithOptions(data, v, options)
+	}
+
+	return fmt.Errorf("unknown session handler: %d", handler)
+}
+
+// fillSession consumes each of the variables of a session written by the php
+// or php_binary handler, and stores them in the map or struct v.
+func (d *decodeState) fillSession(v reflect.Value, handler SessionHandler) error {
+	var fields []structField
+	if v.Kind() == reflect.Struct {
+		fields = structFields(v.Type())
+	} else if v.IsNil() {
+		v.Set(reflect.MakeMap(v.Type()))
+	}
+
+	for offset := 0; offset < len(d.data); {
+		var name string
+		var err error
+		if handler == SessionPHPBinary {
+			undefined := d.data[offset]&binaryUndefined != 0
+			name, offset, err = d.consumeBinaryName(offset)
+			if err != nil {
+				return err
+			}
+
+			// PHP does not set undefined variables either.
+			if undefined {
+				continue
+			}
+		} else {
+			name, offset, err = d.consumeSessionName(offset)
+			if err != nil {
+				return err
+			}
+		}
+
+		d.pushPath(name)
+		if v.Kind() == reflect.Struct {
+			offset, err = d.setSessionField(offset, v, fields, name)
+		} else {
+			offset, err = d.setSessionElement(offset, v, name)
+		}
+		if err != nil {
+			return err
+		}
+		d.popPath()
+	}
+
+	return nil
+}
+
+// consumeSessionName consumes the name of a variable written by the php
+// handler, up to and including the "|".
+func (d *decodeState) consumeSessionName(offset int) (string, int, error) {
+	end := findByte(d.data, '|', offset)
+	if end < 0 {
+		return "", -1, d.syntaxError(len(d.data), `"|"`)
+	}
+
+	return string(d.data[offset:end]), end + 1, nil
+}
+
+// consumeBinaryName consumes the length and name of a variable written by the
+// php_binary handler. The binaryUndefined bit of the length is ignored.
+func (d *decodeState) consumeBinaryName(offset int) (string, int, error) {
+	end := offset + 1 + int(d.data[offset]&maxBinaryNameLength)
+	if end > len(d.data) {
+		return "", -1, d.syntaxError(len(d.data), "variable name")
+	}
+
+	return string(d.data[offset+1 : end]), end, nil
+}
+
+// setSessionField consumes the value of a variable into the matching field of
+// the struct v. Variables that do not have a matching field are discarded.
+func (d *decodeState) setSessionField(offset int, v reflect.Value,
+	fields []structField, name string) (int, error) {
+	field := fieldByName(v, fields, name)
+	if !field.IsValid() {
+		_, offset, err := d.consumeNext(offset)
+		return offset, err
+	}
+
+	return d.setField(offset, field)
+}
+
+// setSessionElement consumes the value of a variable into the map v.
+func (d *decodeState) setSessionElement(offset int, v reflect.Value,
+	name string) (int, error) {
+	mapKey := reflect.New(v.Type().Key()).Elem()
+	err := d.assignKey(offset, mapKey, name)
+	if err != nil {
+		return -1, err
+	}
+
+	element := reflect.New(v.Type().Elem()).Elem()
+	offset, err = d.setField(offset, element)
+	if err != nil {
+		return -1, err
+	}
+
+	v.SetMapIndex(mapKey, element)
+
+	return offset, nil
+}
+
+// EncodeSession encodes a map with string keys, or a struct, as PHP session
+// data for handler. If options is nil DefaultMarshalOptions() is used.
+//
+// The keys of the map, or the names of the fields of the struct, are the names
+// of the variables. The variables of a map are sorted by name. The php handler
+// does not allow names that contain a "|" and the php_binary handler does not
+// allow names that are longer than 127 bytes.
+func EncodeSession(input interface{}, handler SessionHandler,
+	options *MarshalOptions) ([]byte, error) {
+	var buffer bytes.Buffer
+	e := newEncodeState(&buffer, options)
+
+	names, values, err := sessionVariables(reflect.ValueOf(input))
+	if err != nil {
+		return nil, err
+	}
+
+	switch handler {
+	case SessionPHP, SessionPHPBinary:
+		err = e.marshalSession(names, values, handler)
+
+	case SessionPHPSerialize:
+		err = e.marshalSessionArray(names, values)
+
+	default:
+		err = fmt.Errorf("unknown session handler: %d", handler)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer.Bytes(), nil
+}
+
+// sessionVariables returns the names and values of the variables in a map or
+// struct, or a pointer to either of them.
+func sessionVariables(v reflect.Value) ([]string, []reflect.Value, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			break
+		}
+
+		v = v.Elem()
+	}
+
+	var names []string
+	var values []reflect.Value
+
+	switch v.Kind() {
+	case reflect.Map:
+		byName := map[string]reflect.Value{}
+		for _, key := range v.MapKeys() {
+			name := key
+			if name.Kind() == reflect.Interface {
+				name = name.Elem()
+			}
+
+			if name.Kind() != reflect.String {
+				return nil, nil, fmt.Errorf(
+					"can not use %s as a session variable name: %v",
+					key.Type(), key.Interface())
+			}
+
+			names = append(names, name.String())
+			byName[name.String()] = v.MapIndex(key)
+		}
+
+		sort.Strings(names)
+		for _, name := range names {
+			values = append(values, byName[name])
+		}
+
+	case reflect.Struct:
+		for _, field := range structFields(v.Type()) {
+			f, ok := fieldByIndex(v, field.index)
+			if !ok {
+				continue
+			}
+
+			if field.options.Contains("omitnilptr") {
+				if f.Kind() == reflect.Ptr && f.IsNil() {
+					continue
+				}
+			}
+
+			names = append(names, field.name)
+			values = append(values, f)
+		}
+
+	default:
+		if !v.IsValid() {
+			return nil, nil, errors.New("can not encode nil as a session")
+		}
+
+		return nil, nil, fmt.Errorf("can not encode %s as a session", v.Type())
+	}
+
+	return names, values, nil
+}
+
+// marshalSession writes each variable in the format of the php or php_binary
+// handler. The values are numbered as one sequence, so references can refer to
+// values in other variables.
+func (e *encodeState) marshalSession(names []string, values []reflect.Value,
+	handler SessionHandler) error {
+	for i, name := range names {
+		if handler == SessionPHPBinary {
+			if len(name) > maxBinaryNameLength {
+				return fmt.Errorf(
+					"session variable name %q is longer than %d bytes",
+					name, maxBinaryNameLength)
+			}
+
+			e.w.WriteByte(byte(len(name)))
+			e.w.WriteString(name)
+		} else {
+			if strings.IndexByte(name, '|') >= 0 {
+				return fmt.Errorf(
+					`session variable name %q can not contain "|"`, name)
+			}
+
+			e.w.WriteString(name)
+			e.w.WriteByte('|')
+		}
+
+		err := e.marshal(values[i].Interface())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// marshalSessionArray writes the variables as a single array, in the format of
+// the php_serialize handler.
+func (e *encodeState) marshalSessionArray(names []string,
+	values []reflect.Value) error {
+	e.n++
+	e.writeArrayHeader(len(names))
+
+	for i, name := range names {
+		key, err := e.arrayKey(reflect.ValueOf(name))
+		if err != nil {
+			return err
+		}
+
+		err = e.marshalValue(key.Interface())
+		if err != nil {
+			return err
+		}
+
+		err = e.marshal(values[i].Interface())
+		if err != nil {
+			return err
+		}
+	}
+
+	e.w.WriteByte('}')
+
+	return nil
+}
@@ -0,0 +1,235 @@
+package phpserialize_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/elliotchance/phpserialize"
+)
+
+type session struct {
+	UserID int      `php:"user_id"`
+	Name   string   `php:"name"`
+	Roles  []string `php:"roles"`
+}
+
+var sessionTests = map[string]struct {
+	handler phpserialize.SessionHandler
+	data    string
+}{
+	"php": {phpserialize.SessionPHP,
+		`name|s:3:"Bob";roles|a:1:{i:0;s:5:"admin";}user_id|i:42;`},
+	"php_binary": {phpserialize.SessionPHPBinary,
+		"\x04name" + `s:3:"Bob";` + "\x05roles" + `a:1:{i:0;s:5:"admin";}` +
+			"\x07user_id" + `i:42;`},
+	"php_serialize": {phpserialize.SessionPHPSerialize,
+		`a:3:{s:4:"name";s:3:"Bob";s:5:"roles";a:1:{i:0;s:5:"admin";}` +
+			`s:7:"user_id";i:42;}`},
+}
+
+func TestDecodeSession(t *testing.T) {
+	for testName, test := range sessionTests {
+		t.Run(testName, func(t *testing.T) {
+			var result map[string]interface{}
+			err := phpserialize.DecodeSession([]byte(test.data), &result,
+				test.handler, nil)
+			expectErrorToNotHaveOccurred(t, err)
+
+			expected := map[string]interface{}{
+				"name":    "Bob",
+				"roles":   []interface{}{"admin"},
+				"user_id": int64(42),
+			}
+			if !reflect.DeepEqual(result, expected) {
+				t.Errorf("Expected %#v, got %#v", expected, result)
+			}
+		})
+	}
+}
+
+func TestDecodeSessionIntoStruct(t *testing.T) {
+	for testName, test := range sessionTests {
+		t.Run(testName, func(t *testing.T) {
+			var result session
+			err := phpserialize.DecodeSession([]byte(test.data), &result,
+				test.handler, nil)
+			expectErrorToNotHaveOccurred(t, err)
+
+			expected := session{42, "Bob", []string{"admin"}}
+			if !reflect.DeepEqual(result, expected) {
+				t.Errorf("Expected %#v, got %#v", expected, result)
+			}
+		})
+	}
+}
+
+func TestDecodeSessionUndefinedBinaryVariables(t *testing.T) {
+	// The high bit of the length marks a variable that is undefined, which
+	// has no value.
+	data := "\x84gone\x04name" + `s:3:"Bob";` + "\x87user_id"
+
+	var result map[string]interface{}
+	err := phpserialize.DecodeSession([]byte(data), &result,
+		phpserialize.SessionPHPBinary, nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := map[string]interface{}{"name": "Bob"}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, result)
+	}
+
+	var s session
+	err = phpserialize.DecodeSession([]byte(data), &s,
+		phpserialize.SessionPHPBinary, nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if !reflect.DeepEqual(s, session{Name: "Bob"}) {
+		t.Errorf("Unexpected %#v", s)
+	}
+}
+
+func TestEncodeSession(t *testing.T) {
+	for testName, test := range sessionTests {
+		t.Run(testName, func(t *testing.T) {
+			result, err := phpserialize.EncodeSession(map[string]interface{}{
+				"user_id": 42,
+				"name":    "Bob",
+				"roles":   []string{"admin"},
+			}, test.handler, nil)
+			expectErrorToNotHaveOccurred(t, err)
+
+			if string(result) != test.data {
+				t.Errorf("Expected %q, got %q", test.data, result)
+			}
+		})
+	}
+}
+
+func TestEncodeSessionStruct(t *testing.T) {
+	result, err := phpserialize.EncodeSession(
+		&session{42, "Bob", []string{"admin"}}, phpserialize.SessionPHP, nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := `user_id|i:42;name|s:3:"Bob";roles|a:1:{i:0;s:5:"admin";}`
+	if string(result) != expected {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+}
+
+func TestSessionReferences(t *testing.T) {
+	// The values of all of the variables are numbered together, so a
+	// reference can refer to a value in another variable.
+	data := `user|O:8:"stdClass":1:{s:4:"name";s:3:"Bob";}owner|r:1;count|i:1;` +
+		`total|R:4;`
+
+	var result map[string]interface{}
+	err := phpserialize.DecodeSession([]byte(data), &result,
+		phpserialize.SessionPHP, nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if reflect.ValueOf(result["user"]).Pointer() !=
+		reflect.ValueOf(result["owner"]).Pointer() {
+		t.Errorf("Expected the same object, got %v", result)
+	}
+
+	if result["total"] != int64(1) {
+		t.Errorf("Expected 1, got %v", result["total"])
+	}
+
+	type user struct {
+		Name string `php:"name"`
+	}
+	bob := &user{"Bob"}
+	options := phpserialize.DefaultMarshalOptions()
+	options.References = true
+	options.OnlyStdClass = true
+
+	for handler, expected := range map[phpserialize.SessionHandler]string{
+		phpserialize.SessionPHP: `owner|O:8:"stdClass":1:{s:4:"name";` +
+			`s:3:"Bob";}user|r:1;`,
+		phpserialize.SessionPHPSerialize: `a:2:{s:5:"owner";O:8:"stdClass":1:` +
+			`{s:4:"name";s:3:"Bob";}s:4:"user";r:2;}`,
+	} {
+		encoded, err := phpserialize.EncodeSession(map[string]*user{
+			"user":  bob,
+			"owner": bob,
+		}, handler, options)
+		expectErrorToNotHaveOccurred(t, err)
+
+		if string(encoded) != expected {
+			t.Errorf("Expected %q, got %q", expected, encoded)
+		}
+	}
+}
+
+func TestDecodeSessionErrors(t *testing.T) {
+	tests := map[string]struct {
+		data          string
+		handler       phpserialize.SessionHandler
+		target        interface{}
+		expectedError string
+	}{
+		"missing delimiter": {`name`, phpserialize.SessionPHP,
+			new(map[string]interface{}),
+			`syntax error at offset 4 ($): expected "|", found end of data`},
+		"missing value": {`name|`, phpserialize.SessionPHP,
+			new(map[string]interface{}),
+			`syntax error at offset 5 ($.name): expected value, found end of data`},
+		"invalid value": {`name|s:3:"Bob"`, phpserialize.SessionPHP,
+			new(map[string]interface{}),
+			`syntax error at offset 14 ($.name): expected ";", found end of data`},
+		"short name": {"\x05name", phpserialize.SessionPHPBinary,
+			new(map[string]interface{}),
+			`syntax error at offset 5 ($): expected variable name, found end of data`},
+		"wrong type": {`user_id|s:1:"x";`, phpserialize.SessionPHP,
+			new(session),
+			`can not unmarshal string into Go value of type int at offset 8 ($.user_id)`},
+		"not a map": {`name|s:3:"Bob";`, phpserialize.SessionPHP,
+			new(string),
+			`can not unmarshal session into Go value of type string at offset 0 ($)`},
+		"nil": {`name|s:3:"Bob";`, phpserialize.SessionPHP, nil,
+			`can not unmarshal into nil`},
+		"unknown handler": {`name|s:3:"Bob";`, phpserialize.SessionHandler(9),
+			new(map[string]interface{}), `unknown session handler: 9`},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			err := phpserialize.DecodeSession([]byte(test.data), test.target,
+				test.handler, nil)
+			expectErrorToEqual(t, err, errors.New(test.expectedError))
+		})
+	}
+}
+
+func TestEncodeSessionErrors(t *testing.T) {
+	long := strings.Repeat("a", 128)
+
+	tests := map[string]struct {
+		input         interface{}
+		handler       phpserialize.SessionHandler
+		expectedError string
+	}{
+		"delimiter": {map[string]int{"a|b": 1}, phpserialize.SessionPHP,
+			`session variable name "a|b" can not contain "|"`},
+		"long name": {map[string]int{long: 1}, phpserialize.SessionPHPBinary,
+			`session variable name "` + long + `" is longer than 127 bytes`},
+		"int keys": {map[int]int{1: 1}, phpserialize.SessionPHP,
+			"can not use int as a session variable name: 1"},
+		"not a map": {"foo", phpserialize.SessionPHP,
+			"can not encode string as a session"},
+		"nil": {nil, phpserialize.SessionPHP,
+			"can not encode nil as a session"},
+		"unknown handler": {map[string]int{}, phpserialize.SessionHandler(9),
+			"unknown session handler: 9"},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			_, err := phpserialize.EncodeSession(test.input, test.handler, nil)
+			expectErrorToEqual(t, err, errors.New(test.expectedError))
+		})
+	}
+}
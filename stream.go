@@ -0,0 +1,222 @@
+package phpserialize
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// A Decoder reads and decodes serialized values from an input stream.
+//
+// The stream may contain any number of serialized values one after the other,
+// optionally separated by whitespace (such as a new line after each value).
+// Values are decoded as they are read, and the data that has been decoded is
+// discarded, so a stream, or a single value, can be much larger than the
+// available memory. Only the decoded result needs to fit in memory, along with
+// the data of the string, custom object or value for an Unmarshaler that is
+// being read.
+//
+// A reference ("r:N;" or "R:N;") is usually resolved to the Go value that the
+// value it refers to was decoded into. If that value has a Go type that can not
+// be used for the reference, the value has to be decoded again. A Decoder can
+// not do that once the data of the value has been discarded, so an
+// *UnmarshalTypeError is returned instead.
+type Decoder struct {
+	r   io.Reader
+	buf []byte
+
+	// scanp is the start of the unread data in buf. While a value is being
+	// decoded it is the start of the data that has been kept, see
+	// decodeInput.
+	scanp int
+
+	// err is the error returned by r, it is only returned once all of the
+	// data in buf has been used.
+	err error
+
+	// valueErr is the error from decoding a value. The rest of the value
+	// has not been read so no more values can be decoded.
+	valueErr error
+
+	options *DecodeOptions
+}
+
+// NewDecoder returns a new decoder that reads from r.
+//
+// The decoder introduces its own buffering and may read data from r beyond the
+// values requested.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: r, options: DefaultDecodeOptions()}
+}
+
+// SetOptions changes the options used for all values decoded after it is
+// called. See DecodeOptions.
+func (dec *Decoder) SetOptions(options *DecodeOptions) {
+	if options == nil {
+		options = DefaultDecodeOptions()
+	}
+
+	dec.options = options
+}
+
+// Decode reads the next serialized value from its input and stores it in the
+// value pointed to by v. See Unmarshal for details about how the value is
+// decoded.
+//
+// io.EOF is returned when there are no more values. If the input ends part way
+// through a value io.ErrUnexpectedEOF is returned. After any other error the
+// Decoder is part way through the value, so every call to Decode returns the
+// same error.
+func (dec *Decoder) Decode(v interface{}) error {
+	if dec.valueErr != nil {
+		return dec.valueErr
+	}
+
+	if err := dec.skipWhitespace(); err != nil {
+		return err
+	}
+
+	d := newDecodeState(dec.buf[dec.scanp:], dec.options)
+	d.dec = dec
+
+	end, err := d.unmarshal(v)
+	if err != nil {
+		// Nothing has been read for an invalid v.
+		if _, ok := err.(*InvalidUnmarshalError); ok {
+			return err
+		}
+
+		// The value is not complete because the stream ended, or could
+		// not be read.
+		if e, ok := err.(*SyntaxError); ok && e.Found == "end of data" &&
+			dec.err != nil {
+			err = dec.err
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+
+		dec.valueErr = err
+
+		return err
+	}
+
+	dec.scanp += end - d.base
+
+	return nil
+}
+
+// Buffered returns a reader of the data remaining in the Decoder's buffer. The
+// reader is valid until the next call to Decode.
+func (dec *Decoder) Buffered() io.Reader {
+	return bytes.NewReader(dec.buf[dec.scanp:])
+}
+
+// skipWhitespace reads until buf contains the start of the next value at scanp.
+// It returns io.EOF if there are no more values.
+func (dec *Decoder) skipWhitespace() error {
+	for {
+		for ; dec.scanp < len(dec.buf); dec.scanp++ {
+			switch dec.buf[dec.scanp] {
+			case ' ', '\t', '\r', '\n':
+			default:
+				return nil
+			}
+		}
+
+		if dec.err != nil {
+			return dec.err
+		}
+
+		dec.refill(false)
+	}
+}
+
+// readMore is used by decodeInput.fill to read more of the value that is being
+// decoded. The data before in.keep() is discarded first. It returns false if
+// the stream has ended.
+func (dec *Decoder) readMore(in *decodeInput) bool {
+	if dec.err != nil {
+		return false
+	}
+
+	keep := in.keep()
+	if keep > in.end() {
+		keep = in.end()
+	}
+
+	if keep > in.base {
+		dec.scanp += keep - in.base
+		in.base = keep
+	}
+
+	dec.refill(in.pinned)
+	in.data = dec.buf[dec.scanp:]
+
+	return true
+}
+
+// refill reads more data into buf. The data before scanp is discarded first.
+// While pinned is true the data is copied into a new buffer instead of to the
+// start of buf, because slices of buf are still being used.
+func (dec *Decoder) refill(pinned bool) {
+	const minRead = 512
+	if cap(dec.buf)-len(dec.buf) < minRead {
+		n := len(dec.buf) - dec.scanp
+
+		buf := dec.buf[:0]
+		if pinned || n+minRead > cap(buf) {
+			buf = make([]byte, 0, 2*n+minRead)
+		}
+
+		dec.buf = append(buf, dec.buf[dec.scanp:]...)
+		dec.scanp = 0
+	}
+
+	n, err := dec.r.Read(dec.buf[len(dec.buf):cap(dec.buf)])
+	dec.buf = dec.buf[:len(dec.buf)+n]
+	dec.err = err
+}
+
+// An Encoder writes serialized values to an output stream.
+//
+// Values are written to the stream as they are encoded rather than being built
+// in memory first, so very large values can be written with a small, fixed
+// amount of memory.
+type Encoder struct {
+	w       io.Writer
+	options *MarshalOptions
+}
+
+// NewEncoder returns a new encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w, options: DefaultMarshalOptions()}
+}
+
+// SetOptions changes the options used for all values encoded after it is
+// called. See MarshalOptions.
+func (enc *Encoder) SetOptions(options *MarshalOptions) {
+	if options == nil {
+		options = DefaultMarshalOptions()
+	}
+
+	enc.options = options
+}
+
+// Encode writes the serialized value of v to the stream. See Marshal for
+// details about how the value is encoded. Each value is written directly after
+// the previous one, without a separator.
+//
+// If an error occurs while the value is being encoded part of the value may
+// already have been written.
+func (enc *Encoder) Encode(v interface{}) error {
+	w := bufio.NewWriter(enc.w)
+
+	err := newEncodeState(w, enc.options).marshal(v)
+	if err != nil {
+		w.Flush()
+		return err
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,425 @@
+package phpserialize_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/elliotchance/phpserialize"
+)
+
+var streamInput = `i:1;s:7:"a};b:1;";` + "\n" +
+	`a:2:{i:0;O:8:"stdClass":1:{s:1:"a";C:3:"Foo":2:{{}}}i:1;r:2;}` +
+	"\n" + `d:1.5;`
+
+func TestDecoder(t *testing.T) {
+	readers := map[string]func() io.Reader{
+		"reader": func() io.Reader {
+			return strings.NewReader(streamInput)
+		},
+		"one byte reader": func() io.Reader {
+			return iotest.OneByteReader(strings.NewReader(streamInput))
+		},
+		"half reader": func() io.Reader {
+			return iotest.HalfReader(strings.NewReader(streamInput))
+		},
+		"data error reader": func() io.Reader {
+			return iotest.DataErrReader(strings.NewReader(streamInput))
+		},
+	}
+
+	for name, reader := range readers {
+		t.Run(name, func(t *testing.T) {
+			dec := phpserialize.NewDecoder(reader())
+
+			var i int
+			var s string
+			var a []interface{}
+			var f float64
+
+			for _, v := range []interface{}{&i, &s, &a, &f} {
+				expectErrorToNotHaveOccurred(t, dec.Decode(v))
+			}
+
+			if err := dec.Decode(&i); err != io.EOF {
+				t.Errorf("Expected io.EOF, got %v", err)
+			}
+
+			if i != 1 || s != "a};b:1;" || f != 1.5 {
+				t.Errorf("Unexpected values: %v, %q, %v", i, s, f)
+			}
+
+			object := map[interface{}]interface{}{
+				"a": &phpserialize.PHPCustomObject{
+					ClassName: "Foo",
+					Payload:   []byte("{}"),
+				},
+			}
+			expected := []interface{}{object, object}
+			if !reflect.DeepEqual(a, expected) {
+				t.Errorf("Expected:\n  %#+v\nGot:\n  %#+v", expected, a)
+			}
+		})
+	}
+}
+
+func TestDecoderIntoStructs(t *testing.T) {
+	data := `O:7:"Struct2":1:{s:3:"qux";d:1.5;}O:7:"Struct2":1:{s:3:"qux";d:2.5;}`
+	dec := phpserialize.NewDecoder(strings.NewReader(data))
+
+	for _, expected := range []float64{1.5, 2.5} {
+		var result Struct2
+		err := dec.Decode(&result)
+		expectErrorToNotHaveOccurred(t, err)
+
+		if result.Qux != expected {
+			t.Errorf("Expected %v, got %v", expected, result.Qux)
+		}
+	}
+}
+
+func TestDecoderEmpty(t *testing.T) {
+	var result int
+	err := phpserialize.NewDecoder(strings.NewReader(" \n")).Decode(&result)
+
+	if err != io.EOF {
+		t.Errorf("Expected io.EOF, got %v", err)
+	}
+}
+
+func TestDecoderUnexpectedEOF(t *testing.T) {
+	for _, data := range []string{
+		`a:1:{i:0;`,
+		`a:1:{i:0;i:1;`,
+		`s:5:"foo`,
+		`a:1:{i:0;C:3:"Foo":5:{ab`,
+	} {
+		t.Run(data, func(t *testing.T) {
+			dec := phpserialize.NewDecoder(strings.NewReader(data))
+
+			var result interface{}
+			err := dec.Decode(&result)
+
+			if err != io.ErrUnexpectedEOF {
+				t.Errorf("Expected io.ErrUnexpectedEOF, got %v", err)
+			}
+		})
+	}
+}
+
+func TestDecoderSyntaxError(t *testing.T) {
+	var result []interface{}
+	dec := phpserialize.NewDecoder(strings.NewReader(`a:1:{i:0;i:1;i:2;i:3;}`))
+	err := dec.Decode(&result)
+
+	expectErrorToEqual(t, err, errors.New(`syntax error at offset 13 ($): expected "}", found "i"`))
+}
+
+func TestDecoderReadError(t *testing.T) {
+	readErr := errors.New("read failed")
+	r := io.MultiReader(strings.NewReader(`i:1;a:1:{`), iotest.TimeoutReader(
+		iotest.ErrReader(readErr)))
+
+	dec := phpserialize.NewDecoder(r)
+
+	var i int
+	expectErrorToNotHaveOccurred(t, dec.Decode(&i))
+
+	var result []interface{}
+	if err := dec.Decode(&result); err != readErr {
+		t.Errorf("Expected %v, got %v", readErr, err)
+	}
+}
+
+func TestDecoderBuffered(t *testing.T) {
+	dec := phpserialize.NewDecoder(strings.NewReader(`i:1;rest`))
+
+	var result int
+	expectErrorToNotHaveOccurred(t, dec.Decode(&result))
+
+	rest, err := ioutil.ReadAll(dec.Buffered())
+	expectErrorToNotHaveOccurred(t, err)
+
+	if !bytes.Equal(rest, []byte("rest")) {
+		t.Errorf("Expected rest, got %q", rest)
+	}
+}
+
+func TestDecoderLargeStream(t *testing.T) {
+	var buffer bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		buffer.Write(phpserialize.MarshalString(strings.Repeat("x", i)))
+	}
+
+	dec := phpserialize.NewDecoder(&buffer)
+	for i := 0; i < 1000; i++ {
+		var result string
+		expectErrorToNotHaveOccurred(t, dec.Decode(&result))
+
+		if len(result) != i {
+			t.Fatalf("Expected length %d, got %d", i, len(result))
+		}
+	}
+}
+
+func TestDecoderLargeValueInSmallReads(t *testing.T) {
+	// Scanning must continue from where it stopped each time more data is
+	// read, rather than starting the value again.
+	list := make([]int, 100000)
+	data, err := phpserialize.Marshal(list, nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	var result []int
+	done := make(chan error, 1)
+	go func() {
+		dec := phpserialize.NewDecoder(
+			iotest.OneByteReader(bytes.NewReader(data)))
+		done <- dec.Decode(&result)
+	}()
+
+	select {
+	case err := <-done:
+		expectErrorToNotHaveOccurred(t, err)
+
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out decoding a large value")
+	}
+
+	if len(result) != len(list) {
+		t.Errorf("Expected %d elements, got %d", len(list), len(result))
+	}
+}
+
+// countingReader counts the bytes that have been read from r.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += n
+
+	return n, err
+}
+
+func TestDecoderDecodesIncrementally(t *testing.T) {
+	// The element with the index 128 does not fit in an int8. Only the data
+	// before it, and a little more, should have been read.
+	list := make([]int, 100000)
+	for i := range list {
+		list[i] = i
+	}
+
+	data, err := phpserialize.Marshal(list, nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	r := &countingReader{r: bytes.NewReader(data)}
+	dec := phpserialize.NewDecoder(r)
+
+	var result []int8
+	err = dec.Decode(&result)
+	expectErrorToEqual(t, err, errors.New("can not unmarshal int 128 into Go value of type int8 at offset 1332 ($[128])"))
+
+	if r.n > 4096 {
+		t.Errorf("Expected a small part of %d bytes to be read, read %d", len(data), r.n)
+	}
+
+	// The rest of the value has not been read, so the error is returned
+	// again.
+	if err2 := dec.Decode(&result); err2 != err {
+		t.Errorf("Expected %v, got %v", err, err2)
+	}
+}
+
+func TestDecoderMatchesUnmarshal(t *testing.T) {
+	for _, data := range malformedCorpus {
+		for _, v := range []func() interface{}{
+			func() interface{} { return new(interface{}) },
+			func() interface{} { return new(map[interface{}]interface{}) },
+			func() interface{} { return new([]interface{}) },
+			func() interface{} { return new(struct1) },
+			func() interface{} { return new(referenceHolder) },
+			func() interface{} { return new(marshalerHolder) },
+			func() interface{} { return new(map[string][2][]int) },
+		} {
+			expected, result := v(), v()
+			expectedErr := phpserialize.Unmarshal([]byte(data), expected)
+
+			// A Decoder returns io.ErrUnexpectedEOF for data that ends
+			// too soon.
+			if err, ok := expectedErr.(*phpserialize.SyntaxError); ok &&
+				err.Found == "end of data" {
+				expectedErr = io.ErrUnexpectedEOF
+			}
+
+			dec := phpserialize.NewDecoder(
+				iotest.OneByteReader(strings.NewReader(data)))
+			err := dec.Decode(result)
+
+			if fmt.Sprint(err) != fmt.Sprint(expectedErr) {
+				t.Errorf("%s: expected error %v, got %v", data, expectedErr, err)
+			}
+
+			if err == nil && !reflect.DeepEqual(result, expected) {
+				t.Errorf("%s: expected:\n  %#+v\ngot:\n  %#+v", data, expected, result)
+			}
+		}
+	}
+}
+
+func TestDecoderDiscardedReference(t *testing.T) {
+	// Decoding B needs the data of A again, because A was decoded into a
+	// []int and B is a []int8.
+	data := `a:2:{s:1:"a";a:1:{i:0;i:1;}s:1:"b";R:2;}`
+
+	var result struct {
+		A []int
+		B []int8
+	}
+
+	// The Decoder has not discarded A when it is all read at once.
+	dec := phpserialize.NewDecoder(strings.NewReader(data))
+	expectErrorToNotHaveOccurred(t, dec.Decode(&result))
+
+	if !reflect.DeepEqual(result.B, []int8{1}) {
+		t.Errorf("Expected [1], got %v", result.B)
+	}
+
+	dec = phpserialize.NewDecoder(iotest.OneByteReader(strings.NewReader(data)))
+	expectErrorToEqual(t, dec.Decode(&result), errors.New("can not unmarshal reference to a value that has been discarded into Go value of type []int8 at offset 35 ($.b)"))
+}
+
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n < len(p) {
+		n := w.n
+		w.n = 0
+		return n, errors.New("write failed")
+	}
+
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestEncoder(t *testing.T) {
+	var buffer bytes.Buffer
+	enc := phpserialize.NewEncoder(&buffer)
+
+	for _, v := range marshalTests {
+		if v.options != nil {
+			continue
+		}
+
+		buffer.Reset()
+		expectErrorToNotHaveOccurred(t, enc.Encode(v.input))
+
+		if !bytes.Equal(buffer.Bytes(), v.output) {
+			t.Errorf("Expected '%s', got '%s'", v.output, buffer.Bytes())
+		}
+	}
+}
+
+func TestEncoderMultipleValues(t *testing.T) {
+	var buffer bytes.Buffer
+	enc := phpserialize.NewEncoder(&buffer)
+
+	expectErrorToNotHaveOccurred(t, enc.Encode(1))
+	expectErrorToNotHaveOccurred(t, enc.Encode("foo"))
+	expectErrorToNotHaveOccurred(t, enc.Encode([]int{2}))
+
+	expected := `i:1;s:3:"foo";a:1:{i:0;i:2;}`
+	if buffer.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, buffer.String())
+	}
+
+	// The values can be read back with a Decoder.
+	dec := phpserialize.NewDecoder(&buffer)
+
+	var i int
+	var s string
+	var a []interface{}
+	for _, v := range []interface{}{&i, &s, &a} {
+		expectErrorToNotHaveOccurred(t, dec.Decode(v))
+	}
+
+	if i != 1 || s != "foo" || !reflect.DeepEqual(a, []interface{}{int64(2)}) {
+		t.Errorf("Unexpected values: %v, %v, %v", i, s, a)
+	}
+}
+
+func TestEncoderSetOptions(t *testing.T) {
+	var buffer bytes.Buffer
+	enc := phpserialize.NewEncoder(&buffer)
+	enc.SetOptions(getStdClassOnly())
+
+	expectErrorToNotHaveOccurred(t, enc.Encode(Struct2{1}))
+
+	expected := `O:8:"stdClass":1:{s:3:"qux";d:1;}`
+	if buffer.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, buffer.String())
+	}
+
+	buffer.Reset()
+	enc.SetOptions(nil)
+	expectErrorToNotHaveOccurred(t, enc.Encode(Struct2{1}))
+
+	expected = `O:7:"Struct2":1:{s:3:"qux";d:1;}`
+	if buffer.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, buffer.String())
+	}
+}
+
+func TestEncoderLargeValue(t *testing.T) {
+	input := make([]string, 10000)
+	for i := range input {
+		input[i] = strings.Repeat("x", i%100)
+	}
+
+	var buffer bytes.Buffer
+	expectErrorToNotHaveOccurred(t, phpserialize.NewEncoder(&buffer).Encode(input))
+
+	expected, err := phpserialize.Marshal(input, nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if !bytes.Equal(buffer.Bytes(), expected) {
+		t.Errorf("Encoder and Marshal do not produce the same value")
+	}
+}
+
+func TestEncoderEncodeError(t *testing.T) {
+	var buffer bytes.Buffer
+	err := phpserialize.NewEncoder(&buffer).Encode([]interface{}{1, uintptr(1)})
+
+	expectErrorToEqual(t, err, errors.New("can not encode: uintptr"))
+}
+
+func TestEncoderWriteError(t *testing.T) {
+	input := make([]string, 10000)
+	err := phpserialize.NewEncoder(&failingWriter{n: 100}).Encode(input)
+
+	expectErrorToEqual(t, err, errors.New("write failed"))
+}
+
+func TestDecoderSetOptions(t *testing.T) {
+	data := `s:3:"foo";s:20:"aaaaaaaaaaaaaaaaaaaa";`
+	dec := phpserialize.NewDecoder(iotest.OneByteReader(strings.NewReader(data)))
+	dec.SetOptions(&phpserialize.DecodeOptions{MaxBytes: 16})
+
+	var result string
+	err := dec.Decode(&result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	err = dec.Decode(&result)
+	expectErrorToEqual(t, err, errors.New("exceeded MaxBytes of 16 at offset 2 ($)"))
+}
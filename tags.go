@@ -1,6 +1,11 @@
 package phpserialize
 
-import "strings"
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
 
 type tagOptions string
 
@@ -11,6 +16,19 @@ func parseTag(tag string) (string, tagOptions) {
 	return tag, ""
 }
 
+// fieldName returns the PHP property name of a struct field and the options in
+// its tag. Without a name in the tag the field name is used with the first
+// letter converted to lowercase. The name will be "-" if the field should be
+// ignored.
+func fieldName(field reflect.StructField) (string, tagOptions) {
+	name, options := parseTag(field.Tag.Get("php"))
+	if name == "" {
+		name = lowerCaseFirstLetter(field.Name)
+	}
+
+	return name, options
+}
+
 func (o tagOptions) Contains(option string) bool {
 	if len(o) == 0 {
 		return false
@@ -29,3 +47,209 @@ func (o tagOptions) Contains(option string) bool {
 	}
 	return false
 }
+
+// structField is a property of a struct. Like encoding/json, the fields of
+// embedded structs are promoted into the struct that embeds them.
+type structField struct {
+	name    string
+	options tagOptions
+
+	// index is the sequence of field indexes from the outer struct, the same
+	// as reflect.StructField.Index.
+	index []int
+
+	// declaredIn is the struct that the field belongs to. PHP mangles the
+	// names of private properties with the class that declared them.
+	declaredIn reflect.Type
+
+	tagged bool
+}
+
+// fieldCache holds the result of structFields for each struct type, so that
+// the fields of a type are only found once.
+var fieldCache struct {
+	mu     sync.RWMutex
+	fields map[reflect.Type][]structField
+}
+
+// structFields returns the properties of the struct type t, in the order of
+// the fields. See typeFields.
+//
+// The result is shared by every caller, so it must not be modified.
+func structFields(t reflect.Type) []structField {
+	fieldCache.mu.RLock()
+	fields, ok := fieldCache.fields[t]
+	fieldCache.mu.RUnlock()
+	if ok {
+		return fields
+	}
+
+	fields = typeFields(t)
+
+	fieldCache.mu.Lock()
+	defer fieldCache.mu.Unlock()
+
+	if fieldCache.fields == nil {
+		fieldCache.fields = map[reflect.Type][]structField{}
+	}
+	fieldCache.fields[t] = fields
+
+	return fields
+}
+
+// typeFields finds the properties of the struct type t, in the order of the
+// fields.
+//
+// An embedded struct, or pointer to a struct, is flattened unless it has a name
+// in its tag or the "noflatten" option. When more than one field has the same
+// name (and visibility) the least nested one is used. If there are several at
+// the same depth the one with a name in its tag is used, otherwise none of them
+// are.
+func typeFields(t reflect.Type) []structField {
+	type embedded struct {
+		t     reflect.Type
+		index []int
+	}
+
+	var fields []structField
+	hidden := map[string]bool{}
+	visited := map[reflect.Type]bool{}
+	next := []embedded{{t, nil}}
+
+	for len(next) > 0 {
+		current := next
+		next = nil
+
+		var found []structField
+		count := map[string]int{}
+		tagged := map[string]int{}
+
+		for _, e := range current {
+			if visited[e.t] {
+				continue
+			}
+			visited[e.t] = true
+
+			for i := 0; i < e.t.NumField(); i++ {
+				field := e.t.Field(i)
+				name, options := fieldName(field)
+				if name == "-" {
+					continue
+				}
+
+				index := make([]int, len(e.index)+1)
+				copy(index, e.index)
+				index[len(e.index)] = i
+
+				tagName, _ := parseTag(field.Tag.Get("php"))
+				exported := field.PkgPath == ""
+
+				if field.Anonymous && tagName == "" &&
+					!options.Contains("noflatten") {
+					ft := field.Type
+					if ft.Kind() == reflect.Ptr {
+						ft = ft.Elem()
+					}
+
+					if ft.Kind() == reflect.Struct {
+						// A pointer to an unexported struct can not be
+						// created when decoding.
+						if exported || field.Type.Kind() != reflect.Ptr {
+							next = append(next, embedded{ft, index})
+						}
+
+						continue
+					}
+				}
+
+				if !exported {
+					continue
+				}
+
+				f := structField{name, options, index, e.t, tagName != ""}
+				found = append(found, f)
+				count[f.key()]++
+				if f.tagged {
+					tagged[f.key()]++
+				}
+			}
+		}
+
+		for _, f := range found {
+			key := f.key()
+			if hidden[key] {
+				continue
+			}
+
+			if count[key] == 1 || (f.tagged && tagged[key] == 1) {
+				fields = append(fields, f)
+			}
+		}
+
+		// Any name found at this depth hides the same name deeper down,
+		// even if it was ambiguous.
+		for key := range count {
+			hidden[key] = true
+		}
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		return lessIndex(fields[i].index, fields[j].index)
+	})
+
+	return fields
+}
+
+func (f structField) key() string {
+	return f.options.visibility().String() + " " + f.name
+}
+
+func lessIndex(a, b []int) bool {
+	for i := range a {
+		if i >= len(b) {
+			return false
+		}
+
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+
+	return len(a) < len(b)
+}
+
+// fieldByIndex returns the field of v, which may be inside of embedded structs.
+// The second return value is false if it is inside of a nil pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return reflect.Value{}, false
+			}
+
+			v = v.Elem()
+		}
+
+		v = v.Field(x)
+	}
+
+	return v, true
+}
+
+// settableFieldByIndex is the same as fieldByIndex except that nil pointers to
+// embedded structs are allocated.
+func settableFieldByIndex(v reflect.Value, index []int) reflect.Value {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+
+			v = v.Elem()
+		}
+
+		v = v.Field(x)
+	}
+
+	return v
+}
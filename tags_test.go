@@ -0,0 +1,128 @@
+package phpserialize_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/elliotchance/phpserialize"
+)
+
+type embeddedBase struct {
+	Name   string
+	Code   int
+	Secret string `php:"secret,private"`
+}
+
+type EmbeddedAudit struct {
+	Code      int `php:"code"`
+	CreatedBy string
+}
+
+type embeddedChild struct {
+	embeddedBase
+	*EmbeddedAudit
+	Name    string
+	Struct2 `php:",noflatten"`
+}
+
+const embeddedChildData = `O:13:"embeddedChild":5:{` +
+	`s:20:"` + "\x00embeddedBase\x00" + `secret";s:1:"s";` +
+	`s:4:"code";i:2;` +
+	`s:9:"createdBy";s:3:"bob";` +
+	`s:4:"name";s:3:"top";` +
+	`s:7:"struct2";O:7:"Struct2":1:{s:3:"qux";d:1.5;}}`
+
+func TestMarshalEmbeddedStruct(t *testing.T) {
+	input := embeddedChild{
+		embeddedBase:  embeddedBase{Name: "hidden", Code: 1, Secret: "s"},
+		EmbeddedAudit: &EmbeddedAudit{Code: 2, CreatedBy: "bob"},
+		Name:          "top",
+		Struct2:       Struct2{Qux: 1.5},
+	}
+
+	result, err := phpserialize.Marshal(input, nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if string(result) != embeddedChildData {
+		t.Errorf("Expected:\n  %q\nGot:\n  %q", embeddedChildData, result)
+	}
+}
+
+func TestMarshalEmbeddedNilPointer(t *testing.T) {
+	result, err := phpserialize.Marshal(embeddedChild{Name: "top"}, nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := `O:13:"embeddedChild":3:{` +
+		`s:20:"` + "\x00embeddedBase\x00" + `secret";s:0:"";` +
+		`s:4:"name";s:3:"top";` +
+		`s:7:"struct2";O:7:"Struct2":1:{s:3:"qux";d:0;}}`
+	if string(result) != expected {
+		t.Errorf("Expected:\n  %q\nGot:\n  %q", expected, result)
+	}
+}
+
+func TestUnmarshalEmbeddedStruct(t *testing.T) {
+	var result embeddedChild
+	err := phpserialize.Unmarshal([]byte(embeddedChildData), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := embeddedChild{
+		embeddedBase:  embeddedBase{Secret: "s"},
+		EmbeddedAudit: &EmbeddedAudit{Code: 2, CreatedBy: "bob"},
+		Name:          "top",
+		Struct2:       Struct2{Qux: 1.5},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %#+v, got %#+v", expected, result)
+	}
+}
+
+type ambiguousA struct {
+	Value int
+}
+
+type ambiguousB struct {
+	Value int
+}
+
+type ambiguousHolder struct {
+	ambiguousA
+	ambiguousB
+	Other int
+}
+
+func TestMarshalEmbeddedAmbiguousField(t *testing.T) {
+	input := ambiguousHolder{ambiguousA{1}, ambiguousB{2}, 3}
+
+	result, err := phpserialize.Marshal(input, nil)
+	expectErrorToNotHaveOccurred(t, err)
+
+	// Neither of the fields is used.
+	expected := `O:15:"ambiguousHolder":1:{s:5:"other";i:3;}`
+	if string(result) != expected {
+		t.Errorf("Expected %q, got %q", expected, result)
+	}
+}
+
+func TestEmbeddedStructConcurrently(t *testing.T) {
+	// The fields of each type are shared between goroutines.
+	done := make(chan embeddedChild)
+	for i := 0; i < 8; i++ {
+		go func() {
+			var result embeddedChild
+			err := phpserialize.Unmarshal([]byte(embeddedChildData), &result)
+			expectErrorToNotHaveOccurred(t, err)
+
+			_, err = phpserialize.Marshal(result, nil)
+			expectErrorToNotHaveOccurred(t, err)
+
+			done <- result
+		}()
+	}
+
+	for i := 0; i < 8; i++ {
+		if result := <-done; result.Name != "top" {
+			t.Errorf("Expected top, got %q", result.Name)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package phpserialize
 
 import (
 	"bytes"
-	"errors"
 	"reflect"
 	"strconv"
 	"strings"
@@ -22,6 +21,10 @@ func findByte(data []byte, lookingFor byte, offset int) int {
 
 // DecodePHPString converts a string of ASCII bytes (like "Bj\xc3\xb6rk") back
 // into a UTF8 string ("Björk", in that case).
+//
+// PHP does not escape strings so this is not needed for anything that PHP
+// serialized. It is only useful for strings that were encoded with the
+// LegacyStringEscaping option.
 func DecodePHPString(data []byte) string {
 	var buffer bytes.Buffer
 	for i := 0; i < len(data); i++ {
@@ -29,9 +32,18 @@ func DecodePHPString(data []byte) string {
 			if i+1 <= len(data)-1 {
 				switch data[i+1] {
 				case 'x':
-					b, _ := strconv.ParseInt(string(data[i+2:i+4]), 16, 32)
-					buffer.WriteByte(byte(b))
-					i += 3
+					if i+3 < len(data) {
+						b, err := strconv.ParseUint(string(data[i+2:i+4]), 16, 8)
+						if err == nil {
+							buffer.WriteByte(byte(b))
+							i += 3
+							continue
+						}
+					}
+
+					// Otherwise it was a backslash that happened to be
+					// followed by an "x".
+					buffer.WriteByte('\\')
 
 				case 'n':
 					buffer.WriteByte('\n')
@@ -59,12 +71,12 @@ func DecodePHPString(data []byte) string {
 }
 
 func UnmarshalFloat(data []byte) (float64, error) {
-	i, _, err := consumeFloat(data, 0)
+	i, _, err := newDecodeState(data, nil).consumeFloat(0)
 	return i, err
 }
 
 func UnmarshalString(data []byte) (string, error) {
-	i, _, err := consumeString(data, 0)
+	i, _, err := newDecodeState(data, nil).consumeString(0)
 	return i, err
 }
 
@@ -75,22 +87,32 @@ func UnmarshalBytes(data []byte) ([]byte, error) {
 }
 
 func UnmarshalInt(data []byte) (int64, error) {
-	i, _, err := consumeInt(data, 0)
+	i, _, err := newDecodeState(data, nil).consumeInt(0)
 	return i, err
 }
 
+// UnmarshalUint decodes a PHP integer into a uint64. A negative integer
+// returns an *UnmarshalTypeError.
 func UnmarshalUint(data []byte) (uint64, error) {
-	v, err := UnmarshalInt(data)
-	return uint64(v), err
+	d := newDecodeState(data, nil)
+	i, _, err := d.consumeInt(0)
+	if err != nil {
+		return 0, err
+	}
+
+	var v uint64
+	err = d.setInt(0, reflect.ValueOf(&v).Elem(), i)
+
+	return v, err
 }
 
 func UnmarshalNil(data []byte) error {
-	_, _, err := consumeNil(data, 0)
+	_, _, err := newDecodeState(data, nil).consumeNil(0)
 	return err
 }
 
 func UnmarshalBool(data []byte) (bool, error) {
-	v, _, err := consumeBool(data, 0)
+	v, _, err := newDecodeState(data, nil).consumeBool(0)
 	return v, err
 }
 
@@ -99,7 +121,7 @@ func checkType(data []byte, typeCharacter byte, offset int) bool {
 }
 
 func UnmarshalIndexedArray(data []byte) ([]interface{}, error) {
-	v, _, err := consumeIndexedArray(data, 0)
+	v, _, err := newDecodeState(data, nil).consumeIndexedArray(0)
 
 	return v, err
 }
@@ -107,109 +129,309 @@ func UnmarshalIndexedArray(data []byte) ([]interface{}, error) {
 func UnmarshalAssociativeArray(data []byte) (map[interface{}]interface{}, error) {
 	// We may be unmarshalling an object into a map.
 	if checkType(data, 'O', 0) {
-		result, _, err := consumeObjectAsMap(data, 0)
+		result, _, err := newDecodeState(data, nil).consumeObjectAsMap(0)
 
 		return result, err
 	}
 
-	result, _, err := consumeAssociativeArray(data, 0)
+	result, _, err := newDecodeState(data, nil).consumeAssociativeArray(0)
 
 	return result, err
 }
 
 func UnmarshalObject(data []byte, v reflect.Value) error {
-	_, err := consumeObject(data, 0, v)
+	_, err := newDecodeState(data, nil).consumeObject(0, v)
 	return err
 }
 
+// Unmarshaler is implemented by types that can decode a PHP serialized value of
+// themselves. UnmarshalPHP is given exactly one complete value, such as
+// "i:123;" or "a:0:{}". It must copy the data if it needs to keep it after
+// returning.
+type Unmarshaler interface {
+	UnmarshalPHP([]byte) error
+}
+
+var unmarshalerType = reflect.TypeOf((*Unmarshaler)(nil)).Elem()
+
+// SparseArrayMode is how an array that is not a list (with the keys 0, 1, 2,
+// etc) is decoded into a slice. See DecodeOptions.SparseArrays.
+type SparseArrayMode int
+
+const (
+	// SparseArraysError returns an *UnmarshalTypeError for any array that
+	// is not a list.
+	SparseArraysError SparseArrayMode = iota
+
+	// SparseArraysByOrder puts the elements in the slice in the order that
+	// they were serialized, ignoring their keys.
+	SparseArraysByOrder
+
+	// SparseArraysByIndex uses the keys as the indexes of the slice. Any
+	// elements that are missing are zero values, so the array
+	// a:2:{i:1;s:1:"a";i:3;s:1:"b";} becomes []string{"", "a", "", "b"}.
+	// Negative keys return an *UnmarshalTypeError, as do keys that are
+	// larger than the rest of the data could hold elements for, so that a
+	// small amount of data can not create a huge slice.
+	SparseArraysByIndex
+)
+
+// DecodeOptions can be provided to UnmarshalWithOptions and Decoder.SetOptions.
+// Use DefaultDecodeOptions() for sensible defaults.
+//
+// The limits protect against data that would use a huge amount of memory or
+// time to decode. When a limit is reached a *LimitError is returned. A limit
+// of zero means there is no limit.
+type DecodeOptions struct {
+	// MaxDepth is how deep arrays and objects can be nested inside of each
+	// other. The default is 4096.
+	MaxDepth int
+
+	// MaxElements is the total number of array elements and object
+	// properties. The default is no limit.
+	MaxElements int
+
+	// MaxStringLength is the length of any single string, class name or
+	// custom object payload. The default is no limit.
+	MaxStringLength int
+
+	// MaxBytes is the approximate total amount of memory that can be
+	// allocated for strings, arrays and objects. The default is no limit.
+	MaxBytes int
+
+	// AllowedClasses is the equivalent of the allowed_classes option of
+	// PHP's unserialize(). It is called with the class name of each object,
+	// custom object and enum case that is decoded into an interface{}, which
+	// is where the class name decides what is created. See AllowClasses.
+	//
+	// Objects of classes that are not allowed are decoded as a
+	// *PHPIncompleteClass, custom objects as a *PHPCustomObject and enum
+	// cases as a PHPEnum, without using the Registry. The default is nil,
+	// which allows all classes.
+	AllowedClasses func(className string) bool
+
+	// If this is true a *DisallowedClassError is returned for objects of
+	// classes that are not allowed, instead of decoding them. The default
+	// value is false.
+	RejectDisallowedClasses bool
+
+	// If this is true objects that are decoded into an interface{} are
+	// decoded as a *PHPObject instead of a map, so that the class name and
+	// the order of the properties are kept. Objects of registered classes
+	// still use their Go type. The default value is false.
+	PreserveObjects bool
+
+	// If this is true arrays that are decoded into an interface{} and are not
+	// lists (with the keys 0, 1, 2, etc) are decoded as an *OrderedArray
+	// instead of a map, so that the order of their keys is kept. The default
+	// value is false.
+	OrderedArrays bool
+
+	// SparseArrays decides how an array with integer keys that are not 0, 1,
+	// 2, etc is decoded into a slice. Arrays with string keys can never be
+	// decoded into a slice. The default is SparseArraysError.
+	SparseArrays SparseArrayMode
+
+	// If this is true values are converted into the Go type that they are
+	// decoded into, using the same rules that PHP uses to convert types:
+	//
+	//   - Numeric strings (like "9.99" or " 12") become integers or floats.
+	//     Floats are truncated to integers.
+	//   - Integers, floats and strings become bools. 0, 0.0, "" and "0" are
+	//     false and everything else is true.
+	//   - Bools, integers and floats become strings. true is "1" and false is
+	//     "".
+	//   - Bools become 0 or 1.
+	//   - Null becomes the zero value of any type.
+	//
+	// Values that can not be converted, such as strings that are not numeric
+	// into integers, and arrays or objects into scalars, still return an
+	// *UnmarshalTypeError. The default value is false, which returns an
+	// *UnmarshalTypeError for any value that is not already the right type.
+	TypeJuggling bool
+
+	// Registry is used to find the Go types of objects and the decoders of
+	// custom objects. The default is nil, which uses DefaultRegistry.
+	Registry *Registry
+}
+
+// DefaultDecodeOptions will create a new instance of DecodeOptions with
+// sensible defaults. See DecodeOptions for a full description of options.
+func DefaultDecodeOptions() *DecodeOptions {
+	options := new(DecodeOptions)
+	options.MaxDepth = 4096
+	options.MaxElements = 0
+	options.MaxStringLength = 0
+	options.MaxBytes = 0
+	options.AllowedClasses = nil
+	options.RejectDisallowedClasses = false
+	options.PreserveObjects = false
+	options.OrderedArrays = false
+	options.SparseArrays = SparseArraysError
+	options.TypeJuggling = false
+	options.Registry = nil
+
+	return options
+}
+
+// Unmarshal decodes data into the value pointed to by v, using the default
+// options. See UnmarshalWithOptions.
 func Unmarshal(data []byte, v interface{}) error {
-	value := reflect.ValueOf(v).Elem()
+	return UnmarshalWithOptions(data, v, nil)
+}
 
-	switch value.Kind() {
-	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		v, err := UnmarshalInt(data)
-		if err != nil {
-			return err
+// UnmarshalWithOptions decodes data into the value pointed to by v. If options
+// is nil DefaultDecodeOptions() is used.
+//
+// v can point to any type that the value can be stored in: a bool, any integer
+// or float type, a string or []byte, a struct, a slice, an array, a map, a
+// pointer or interface{}. Slices, arrays, maps and pointers are decoded
+// recursively into their element types.
+//
+// Integers that do not fit in the integer type they are decoded into, such as
+// i:300; into an int8 or a negative integer into a uint, return an
+// *UnmarshalTypeError instead of overflowing.
+func UnmarshalWithOptions(data []byte, v interface{}, options *DecodeOptions) error {
+	_, err := newDecodeState(data, options).unmarshal(v)
+
+	return err
+}
+
+// unmarshal decodes the value at the start of the data into the value pointed
+// to by v and returns the offset after it.
+func (d *decodeState) unmarshal(v interface{}) (int, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return -1, &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+
+	if u, ok := v.(Unmarshaler); ok {
+		// Unmarshal passes all of the data, but a Decoder has to find the
+		// end of the value first.
+		if d.dec != nil {
+			return d.unmarshalWith(0, u)
 		}
 
-		value.SetInt(v)
+		return len(d.data), u.UnmarshalPHP(d.data)
+	}
+
+	value := rv.Elem()
+
+	// The registered cases of an enum are usually strings or integers in Go.
+	if d.isType(0, 'E') {
+		return d.setField(0, value)
+	}
 
-	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
-		v, err := UnmarshalUint(data)
+	// Any scalar can be converted into any other scalar type.
+	if d.options.TypeJuggling && isScalar(value.Type()) {
+		return d.setField(0, value)
+	}
+
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v, offset, err := d.consumeInt(0)
 		if err != nil {
-			return err
+			return -1, err
 		}
 
-		value.SetUint(v)
+		return offset, d.setInt(0, value, v)
 
 	case reflect.Float32, reflect.Float64:
-		v, err := UnmarshalFloat(data)
+		v, offset, err := d.consumeFloat(0)
 		if err != nil {
-			return err
+			return -1, err
 		}
 
-		value.SetFloat(v)
+		return offset, d.setFloat(0, value, v)
 
 	case reflect.Bool:
-		v, err := UnmarshalBool(data)
+		v, offset, err := d.consumeBool(0)
 		if err != nil {
-			return err
+			return -1, err
 		}
 
 		value.SetBool(v)
 
+		return offset, nil
+
 	case reflect.String:
-		v, err := UnmarshalString(data)
+		v, offset, err := d.consumeString(0)
 		if err != nil {
-			return err
+			return -1, err
 		}
 
 		value.SetString(v)
 
-	case reflect.Slice:
+		return offset, nil
+
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct:
 		// uint8 is an alias for byte. This means we are trying to pull
 		// a binary string out.
-		if value.Type().Elem().Kind() == reflect.Uint8 {
-			v, err := UnmarshalBytes(data)
+		if value.Kind() == reflect.Slice &&
+			value.Type().Elem().Kind() == reflect.Uint8 {
+			v, offset, err := d.consumeString(0)
 			if err != nil {
-				return err
+				return -1, err
 			}
 
-			value.SetBytes(v)
-			return nil
+			value.SetBytes([]byte(v))
+			return offset, nil
 		}
 
-		// Otherwise this must be a slice (array)
-		v, err := UnmarshalIndexedArray(data)
-		if err != nil {
-			return err
+		// Unlike the elements of an array, the value itself can not be
+		// null.
+		if expected := expectedContainer(d.byteAt(0), value.Type()); expected != "" {
+			return -1, d.syntaxError(0, expected)
 		}
 
-		value.Set(reflect.ValueOf(v))
-		return nil
+		return d.setField(0, value)
 
-	case reflect.Map:
-		v, err := UnmarshalAssociativeArray(data)
-		if err != nil {
-			return err
-		}
+	default:
+		return d.setField(0, value)
+	}
+}
 
-		value.Set(reflect.ValueOf(v))
-		return nil
+// isScalar returns true if t holds a PHP bool, integer, float or string.
+func isScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
 
-	case reflect.Struct:
-		err := UnmarshalObject(data, value)
-		if err != nil {
-			return err
-		}
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.Uint8
+	}
 
-		return nil
+	return false
+}
 
-	default:
-		return errors.New("can not unmarshal type: " + value.Kind().String())
+// expectedContainer returns what a value of the type kind (such as 'a') must be
+// instead to be decoded into a slice, array, map or struct of type t, or "" if
+// it already is one. A custom object can be decoded into any type that its
+// registered decoder returns.
+func expectedContainer(kind byte, t reflect.Type) string {
+	switch {
+	case kind == 'C':
+		return ""
+
+	case kind == 'a' && t != phpObjectType:
+		return ""
+
+	case kind == 'O' && t.Kind() == reflect.Map:
+		return ""
+
+	case kind == 'O' && t.Kind() == reflect.Struct &&
+		t != orderedArrayType:
+		return ""
+
+	case t.Kind() == reflect.Struct && t != orderedArrayType:
+		return "object"
 	}
 
-	return nil
+	return "array"
 }
 
 func upperCaseFirstLetter(s string) string {
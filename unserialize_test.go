@@ -1,9 +1,15 @@
 package phpserialize_test
 
 import (
+	"bytes"
 	"errors"
+	"math"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/elliotchance/phpserialize"
 )
@@ -38,7 +44,9 @@ func TestUnmarshalInt(t *testing.T) {
 		"5":              {[]byte("i:5;"), 5, nil},
 		"-8":             {[]byte("i:-8;"), -8, nil},
 		"1000000":        {[]byte("i:1000000;"), 1000000, nil},
-		"not an integer": {[]byte("N;"), 0, errors.New("not an integer")},
+		"127":            {[]byte("i:127;"), 127, nil},
+		"+8":             {[]byte("i:+8;"), 8, nil},
+		"not an integer": {[]byte("N;"), 0, errors.New(`syntax error at offset 0 ($): expected integer, found "N"`)},
 	}
 
 	for testName, test := range tests {
@@ -58,6 +66,10 @@ func TestUnmarshalInt(t *testing.T) {
 			})
 
 			t.Run("int8", func(t *testing.T) {
+				if int(int8(test.output)) != test.output {
+					t.Skip("does not fit, see TestUnmarshalIntOverflow")
+				}
+
 				var result int8
 				err := phpserialize.Unmarshal(test.input, &result)
 
@@ -72,6 +84,10 @@ func TestUnmarshalInt(t *testing.T) {
 			})
 
 			t.Run("int16", func(t *testing.T) {
+				if int(int16(test.output)) != test.output {
+					t.Skip("does not fit, see TestUnmarshalIntOverflow")
+				}
+
 				var result int16
 				err := phpserialize.Unmarshal(test.input, &result)
 
@@ -114,6 +130,10 @@ func TestUnmarshalInt(t *testing.T) {
 			})
 
 			t.Run("uint", func(t *testing.T) {
+				if test.output < 0 {
+					t.Skip("does not fit, see TestUnmarshalIntOverflow")
+				}
+
 				var result uint
 				err := phpserialize.Unmarshal(test.input, &result)
 
@@ -128,6 +148,10 @@ func TestUnmarshalInt(t *testing.T) {
 			})
 
 			t.Run("uint8", func(t *testing.T) {
+				if test.output < 0 || int(uint8(test.output)) != test.output {
+					t.Skip("does not fit, see TestUnmarshalIntOverflow")
+				}
+
 				var result uint8
 				err := phpserialize.Unmarshal(test.input, &result)
 
@@ -142,6 +166,10 @@ func TestUnmarshalInt(t *testing.T) {
 			})
 
 			t.Run("uint16", func(t *testing.T) {
+				if test.output < 0 || int(uint16(test.output)) != test.output {
+					t.Skip("does not fit, see TestUnmarshalIntOverflow")
+				}
+
 				var result uint16
 				err := phpserialize.Unmarshal(test.input, &result)
 
@@ -156,6 +184,10 @@ func TestUnmarshalInt(t *testing.T) {
 			})
 
 			t.Run("uint32", func(t *testing.T) {
+				if test.output < 0 {
+					t.Skip("does not fit, see TestUnmarshalIntOverflow")
+				}
+
 				var result uint32
 				err := phpserialize.Unmarshal(test.input, &result)
 
@@ -170,6 +202,10 @@ func TestUnmarshalInt(t *testing.T) {
 			})
 
 			t.Run("uint64", func(t *testing.T) {
+				if test.output < 0 {
+					t.Skip("does not fit, see TestUnmarshalIntOverflow")
+				}
+
 				var result uint64
 				err := phpserialize.Unmarshal(test.input, &result)
 
@@ -186,6 +222,101 @@ func TestUnmarshalInt(t *testing.T) {
 	}
 }
 
+func TestUnmarshalIntOverflow(t *testing.T) {
+	tests := map[string]struct {
+		input         string
+		target        interface{}
+		expected      interface{}
+		expectedError string
+	}{
+		"-8 int8": {"i:-8;", new(int8), int8(-8), ""},
+		"-8 uint": {"i:-8;", new(uint), nil,
+			"can not unmarshal int -8 into Go value of type uint at offset 0 ($)"},
+		"-8 uint8": {"i:-8;", new(uint8), nil,
+			"can not unmarshal int -8 into Go value of type uint8 at offset 0 ($)"},
+		"-8 uint16": {"i:-8;", new(uint16), nil,
+			"can not unmarshal int -8 into Go value of type uint16 at offset 0 ($)"},
+		"-8 uint32": {"i:-8;", new(uint32), nil,
+			"can not unmarshal int -8 into Go value of type uint32 at offset 0 ($)"},
+		"-8 uint64": {"i:-8;", new(uint64), nil,
+			"can not unmarshal int -8 into Go value of type uint64 at offset 0 ($)"},
+		"128 int8": {"i:128;", new(int8), nil,
+			"can not unmarshal int 128 into Go value of type int8 at offset 0 ($)"},
+		"-129 int8": {"i:-129;", new(int8), nil,
+			"can not unmarshal int -129 into Go value of type int8 at offset 0 ($)"},
+		"255 uint8": {"i:255;", new(uint8), uint8(255), ""},
+		"256 uint8": {"i:256;", new(uint8), nil,
+			"can not unmarshal int 256 into Go value of type uint8 at offset 0 ($)"},
+		"1000000 int8": {"i:1000000;", new(int8), nil,
+			"can not unmarshal int 1000000 into Go value of type int8 at offset 0 ($)"},
+		"1000000 int16": {"i:1000000;", new(int16), nil,
+			"can not unmarshal int 1000000 into Go value of type int16 at offset 0 ($)"},
+		"1000000 uint8": {"i:1000000;", new(uint8), nil,
+			"can not unmarshal int 1000000 into Go value of type uint8 at offset 0 ($)"},
+		"1000000 uint16": {"i:1000000;", new(uint16), nil,
+			"can not unmarshal int 1000000 into Go value of type uint16 at offset 0 ($)"},
+		"1000000 int32": {"i:1000000;", new(int32), int32(1000000), ""},
+		"2147483648 int32": {"i:2147483648;", new(int32), nil,
+			"can not unmarshal int 2147483648 into Go value of type int32 at offset 0 ($)"},
+		"4294967295 uint32": {"i:4294967295;", new(uint32), uint32(4294967295), ""},
+		"4294967296 int64":  {"i:4294967296;", new(int64), int64(4294967296), ""},
+		"PHP_INT_MAX": {"i:9223372036854775807;", new(int64),
+			int64(9223372036854775807), ""},
+		"PHP_INT_MIN": {"i:-9223372036854775808;", new(int64),
+			int64(-9223372036854775808), ""},
+		"PHP_INT_MAX uint64": {"i:9223372036854775807;", new(uint64),
+			uint64(9223372036854775807), ""},
+		"too large": {"i:9223372036854775808;", new(int64), nil,
+			"can not unmarshal int 9223372036854775808 into Go value of type int64 at offset 0 ($)"},
+		"too large uint64": {"i:18446744073709551615;", new(uint64), nil,
+			"can not unmarshal int 18446744073709551615 into Go value of type int64 at offset 0 ($)"},
+		"too large interface": {"a:1:{i:0;i:-9223372036854775809;}",
+			new(interface{}), nil,
+			"can not unmarshal int -9223372036854775809 into Go value of type int64 at offset 9 ($[0])"},
+		"array element": {"a:2:{i:0;i:1;i:1;i:300;}", new([]int8), nil,
+			"can not unmarshal int 300 into Go value of type int8 at offset 17 ($[1])"},
+		"struct field": {`O:8:"stdClass":1:{s:4:"uint";i:-1;}`,
+			new(struct{ Uint uint16 }), nil,
+			"can not unmarshal int -1 into Go value of type uint16 at offset 29 ($.uint)"},
+		"map value": {`a:1:{s:1:"a";i:70000;}`, new(map[string]uint16), nil,
+			"can not unmarshal int 70000 into Go value of type uint16 at offset 13 ($.a)"},
+		"float32": {"d:1.0E+39;", new(float32), nil,
+			"can not unmarshal float 1e+39 into Go value of type float32 at offset 0 ($)"},
+		"float32 INF": {"d:INF;", new(float32), float32(math.Inf(1)), ""},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			err := phpserialize.Unmarshal([]byte(test.input), test.target)
+			if test.expectedError != "" {
+				expectErrorToEqual(t, err, errors.New(test.expectedError))
+				if _, ok := err.(*phpserialize.UnmarshalTypeError); !ok {
+					t.Errorf("Expected *UnmarshalTypeError, got %T", err)
+				}
+				return
+			}
+
+			expectErrorToNotHaveOccurred(t, err)
+			result := reflect.ValueOf(test.target).Elem().Interface()
+			if result != test.expected {
+				t.Errorf("Expected %v, got %v", test.expected, result)
+			}
+		})
+	}
+}
+
+func TestUnmarshalUint(t *testing.T) {
+	result, err := phpserialize.UnmarshalUint([]byte("i:9223372036854775807;"))
+	expectErrorToNotHaveOccurred(t, err)
+	if result != math.MaxInt64 {
+		t.Errorf("Expected %v, got %v", uint64(math.MaxInt64), result)
+	}
+
+	_, err = phpserialize.UnmarshalUint([]byte("i:-1;"))
+	expectErrorToEqual(t, err, errors.New(
+		"can not unmarshal int -1 into Go value of type uint64 at offset 0 ($)"))
+}
+
 func TestUnmarshalFloat(t *testing.T) {
 	tests := map[string]struct {
 		input         []byte
@@ -197,7 +328,7 @@ func TestUnmarshalFloat(t *testing.T) {
 		"123.456789":  {[]byte("d:123.456789;"), 123.456789, nil},
 		"1.23e9":      {[]byte("d:1230000000;"), 1.23e9, nil},
 		"-17.23":      {[]byte("d:3.2;"), 3.2, nil},
-		"not a float": {[]byte("N;"), 0.0, errors.New("not a float")},
+		"not a float": {[]byte("N;"), 0.0, errors.New(`syntax error at offset 0 ($): expected float, found "N"`)},
 	}
 
 	for testName, test := range tests {
@@ -246,8 +377,11 @@ func TestUnmarshalString(t *testing.T) {
 			"Björk Guðmundsdóttir",
 			nil,
 		},
-		"not a string": {[]byte("N;"), "", errors.New("not a string")},
+		"not a string": {[]byte("N;"), "", errors.New(`syntax error at offset 0 ($): expected string, found "N"`)},
 		"Backslash":    {[]byte("s:1:\"\\\";"), "\\", nil},
+		"Escaped hex":  {[]byte(`s:4:"\x41";`), `\x41`, nil},
+		"wrong length": {[]byte(`s:4:"foo";`), "", errors.New(`syntax error at offset 9 ($): expected "\"", found ";"`)},
+		"too long":     {[]byte(`s:40:"foo";`), "", errors.New(`syntax error at offset 11 ($): expected "\"", found end of data`)},
 	}
 
 	for testName, test := range tests {
@@ -278,7 +412,7 @@ func TestUnmarshalBinary(t *testing.T) {
 			[]byte{1, 2, 3},
 			nil,
 		},
-		"not a string": {[]byte("N;"), []byte{}, errors.New("not a string")},
+		"not a string": {[]byte("N;"), []byte{}, errors.New(`syntax error at offset 0 ($): expected string, found "N"`)},
 	}
 
 	for testName, test := range tests {
@@ -372,12 +506,12 @@ func TestUnmarshalArray(t *testing.T) {
 		"cannot decode map as slice": {
 			[]byte("a:2:{i:0;b:1;i:5;b:0;}"),
 			[]interface{}{},
-			errors.New("cannot decode map as slice"),
+			errors.New("can not unmarshal associative array into Go value of type []interface {} at offset 13 ($)"),
 		},
 		"not an array": {
 			[]byte("N;"),
 			[]interface{}{},
-			errors.New("not an array"),
+			errors.New(`syntax error at offset 0 ($): expected array, found "N"`),
 		},
 	}
 
@@ -435,7 +569,7 @@ func TestUnmarshalAssociativeArray(t *testing.T) {
 		"not an array": {
 			[]byte("N;"),
 			map[interface{}]interface{}{},
-			errors.New("not an array"),
+			errors.New(`syntax error at offset 0 ($): expected array, found "N"`),
 		},
 	}
 
@@ -463,9 +597,10 @@ var inputBoolTrue = []byte("b:1;")
 func TestUnmarshalWithNull(t *testing.T) {
 	result := interface{}(nil)
 	err := phpserialize.Unmarshal(inputNull, &result)
+	expectErrorToNotHaveOccurred(t, err)
 
-	if err == nil {
-		t.Errorf("expected error")
+	if result != nil {
+		t.Errorf("Expected nil, got %#+v", result)
 	}
 }
 
@@ -723,7 +858,13 @@ var escapeTests = map[string]struct {
 	Unserialized, Serialized string
 }{
 	"SingleQuote": {
-		"foo'bar", `s:8:"foo\'bar";`,
+		"foo'bar", `s:7:"foo'bar";`,
+	},
+	"QuoteAndSemicolon": {
+		`foo";bar`, `s:8:"foo";bar";`,
+	},
+	"NullByte": {
+		"foo\x00bar", "s:7:\"foo\x00bar\";",
 	},
 	"DoubleQuote": {
 		"foo\"bar", `s:7:"foo"bar";`,
@@ -758,3 +899,716 @@ func TestUnmarshalEscape(t *testing.T) {
 		})
 	}
 }
+
+type referenceHolder struct {
+	A *Struct2
+	B *Struct2
+	C Struct2
+}
+
+type selfReferencing struct {
+	Name string
+	Self *selfReferencing
+}
+
+func TestUnmarshalObjectReferenceIntoMap(t *testing.T) {
+	data := `O:3:"Foo":2:{s:1:"a";O:8:"stdClass":1:{s:1:"x";i:1;}s:1:"b";r:2;}`
+	var result map[interface{}]interface{}
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	a := result["a"].(map[interface{}]interface{})
+	b := result["b"].(map[interface{}]interface{})
+
+	if !reflect.DeepEqual(a, map[interface{}]interface{}{"x": int64(1)}) {
+		t.Errorf("Unexpected value: %#+v", a)
+	}
+
+	// Both properties must be the same map, not just equal maps.
+	a["y"] = true
+	if b["y"] != true {
+		t.Errorf("Expected a and b to be the same object")
+	}
+}
+
+func TestUnmarshalValueReferenceIntoSlice(t *testing.T) {
+	data := `a:3:{i:0;s:3:"foo";i:1;R:2;i:2;R:1;}`
+	var result []interface{}
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if result[0] != "foo" || result[1] != "foo" {
+		t.Errorf("Unexpected value: %#+v", result)
+	}
+
+	if self, ok := result[2].([]interface{}); !ok || len(self) != 3 {
+		t.Errorf("Expected reference to the array itself, got %#+v", result[2])
+	}
+}
+
+func TestUnmarshalReferenceNumbering(t *testing.T) {
+	// Array keys are not numbered. "r:" takes a number but "R:" does not.
+	data := `a:4:{s:1:"a";O:8:"stdClass":0:{}s:1:"b";r:2;s:1:"c";R:2;s:1:"d";r:3;}`
+	var result map[interface{}]interface{}
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	a := result["a"].(map[interface{}]interface{})
+	a["x"] = 1
+
+	for _, key := range []string{"b", "c", "d"} {
+		if m, ok := result[key].(map[interface{}]interface{}); !ok || m["x"] != 1 {
+			t.Errorf("Expected %s to reference a, got %#+v", key, result[key])
+		}
+	}
+}
+
+func TestUnmarshalReferenceIntoStruct(t *testing.T) {
+	data := `O:15:"referenceHolder":3:{s:1:"a";O:7:"Struct2":1:{s:3:"qux";d:1.5;}s:1:"b";r:2;s:1:"c";r:2;}`
+	var result referenceHolder
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if result.A == nil || result.A != result.B {
+		t.Errorf("Expected A and B to be the same pointer, got %p and %p",
+			result.A, result.B)
+	}
+
+	if result.A.Qux != 1.5 || result.C.Qux != 1.5 {
+		t.Errorf("Unexpected value: %#+v", result)
+	}
+}
+
+func TestUnmarshalCyclicReferenceIntoStruct(t *testing.T) {
+	data := `O:15:"selfReferencing":2:{s:4:"name";s:3:"foo";s:4:"self";r:1;}`
+	var result selfReferencing
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if result.Self != &result {
+		t.Errorf("Expected Self to point to the object itself, got %p", result.Self)
+	}
+}
+
+func TestUnmarshalCyclicReferenceIntoMap(t *testing.T) {
+	data := `O:8:"stdClass":1:{s:4:"self";r:1;}`
+	var result map[interface{}]interface{}
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	self := result["self"].(map[interface{}]interface{})
+	if _, ok := self["self"]; !ok {
+		t.Errorf("Expected self to be the object itself")
+	}
+}
+
+func TestUnmarshalInvalidReference(t *testing.T) {
+	data := `a:1:{i:0;r:5;}`
+	var result []interface{}
+	err := phpserialize.Unmarshal([]byte(data), &result)
+
+	expectErrorToEqual(t, err, errors.New(`syntax error at offset 11 ($[0]): expected reference from 1 to 1, found "5"`))
+}
+
+func TestUnmarshalNestedReferencesAreDecodedOnce(t *testing.T) {
+	// Each level refers to the level before it twice. Decoding the last level
+	// into a typed slice must not decode each level again for every
+	// reference to it, which would take 2^levels steps.
+	const levels = 40
+
+	// The object is slot 1, the array is slot 2, level 0 is slot 3 (and its
+	// element is slot 4) and level k is slot 4+k.
+	slot := func(level int) int {
+		if level == 0 {
+			return 3
+		}
+
+		return 4 + level
+	}
+
+	data := `O:8:"stdClass":2:{s:1:"g";a:` + strconv.Itoa(levels+1) +
+		`:{i:0;a:1:{i:0;i:1;}`
+	for k := 1; k <= levels; k++ {
+		ref := "R:" + strconv.Itoa(slot(k-1)) + ";"
+		data += "i:" + strconv.Itoa(k) + ";a:2:{i:0;" + ref + "i:1;" + ref + "}"
+	}
+	data += `}s:1:"t";R:` + strconv.Itoa(slot(levels)) + ";}"
+
+	typ := reflect.TypeOf([]int{})
+	for k := 1; k <= levels; k++ {
+		typ = reflect.SliceOf(typ)
+	}
+
+	result := reflect.New(reflect.StructOf([]reflect.StructField{
+		{Name: "G", Type: reflect.TypeOf((*interface{})(nil)).Elem(),
+			Tag: `php:"g"`},
+		{Name: "T", Type: typ, Tag: `php:"t"`},
+	}))
+	done := make(chan error, 1)
+	go func() {
+		done <- phpserialize.Unmarshal([]byte(data), result.Interface())
+	}()
+
+	select {
+	case err := <-done:
+		expectErrorToNotHaveOccurred(t, err)
+
+	case <-time.After(10 * time.Second):
+		t.Fatal("Timed out decoding nested references")
+	}
+
+	v := result.Elem().Field(1)
+	for k := 0; k < levels; k++ {
+		v = v.Index(1)
+	}
+
+	if v.Index(0).Int() != 1 {
+		t.Errorf("Expected 1, got %v", v)
+	}
+}
+
+func TestUnmarshalObjectWithVisibility(t *testing.T) {
+	data := "O:3:\"Foo\":4:{s:6:\"public\";s:1:\"a\";s:7:\"\x00*\x00prot\";i:1;s:12:\"\x00Foo\x00private\";s:1:\"b\";s:8:\"\x00*\x00other\";i:2;}"
+	var result structVisibility
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := structVisibility{"a", 1, "b"}
+	if result != expected {
+		t.Errorf("Expected:\n  %#+v\nGot:\n  %#+v", expected, result)
+	}
+}
+
+func TestUnmarshalObjectVisibilityMustMatch(t *testing.T) {
+	// A public property will not be stored in a protected field, and a
+	// protected property will not be stored in a public field.
+	data := "O:3:\"Foo\":2:{s:4:\"prot\";i:1;s:9:\"\x00*\x00public\";s:1:\"a\";}"
+	var result structVisibility
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if result != (structVisibility{}) {
+		t.Errorf("Expected no fields to be set, got %#+v", result)
+	}
+}
+
+func TestUnmarshalUnmarshaler(t *testing.T) {
+	var result money
+	err := phpserialize.Unmarshal([]byte(`s:5:"12.34";`), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if result != 1234 {
+		t.Errorf("Expected 1234, got %d", result)
+	}
+}
+
+func TestUnmarshalUnmarshalerFields(t *testing.T) {
+	data := `O:15:"marshalerHolder":2:{` +
+		`s:5:"price";s:5:"12.34";` +
+		`s:6:"prices";a:2:{i:0;s:4:"0.05";i:1;s:4:"6.00";}}`
+
+	var result marshalerHolder
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if result.Price != 1234 || !reflect.DeepEqual(result.Prices, []money{5, 600}) {
+		t.Errorf("Unexpected value: %#+v", result)
+	}
+}
+
+func TestUnmarshalUnmarshalerReferenceNumbering(t *testing.T) {
+	// The object is 1, the array given to the Unmarshaler is 2 to 4 and
+	// the Struct2 is 5.
+	data := `O:15:"referenceHolder":3:{` +
+		`s:6:"prices";a:2:{i:0;s:4:"0.05";i:1;s:4:"6.00";}` +
+		`s:1:"a";O:7:"Struct2":1:{s:3:"qux";d:1.5;}` +
+		`s:1:"b";r:5;}`
+
+	var result struct {
+		Prices []money
+		A      *Struct2
+		B      *Struct2
+	}
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	if result.A == nil || result.A != result.B {
+		t.Errorf("Unexpected value: %#+v", result)
+	}
+}
+
+// malformedCorpus is valid serialized data that is truncated and corrupted by
+// TestUnmarshalMalformed and used as the seed corpus for FuzzUnmarshal.
+var malformedCorpus = []string{
+	`N;`,
+	`b:1;`,
+	`i:-123;`,
+	`d:1.5;`,
+	`s:3:"foo";`,
+	`s:6:"中文";`,
+	`E:13:"Status:Active";`,
+	`E:4:"Foo:";`,
+	`a:1:{i:0;E:3:"a:b"}`,
+	`a:2:{i:0;i:1;i:1;s:1:"a";}`,
+	`a:2:{s:3:"foo";i:10;s:3:"bar";a:1:{i:0;b:0;}}`,
+	`O:7:"struct1":3:{s:3:"foo";i:10;s:3:"bar";O:7:"Struct2":1:{s:3:"qux";d:1.25;}s:3:"baz";s:3:"yay";}`,
+	`O:15:"referenceHolder":3:{s:1:"a";O:7:"Struct2":1:{s:3:"qux";d:1.5;}s:1:"b";r:2;s:1:"c";r:2;}`,
+	`O:14:"selfReferencing":2:{s:4:"self";r:1;s:5:"value";R:2;}`,
+	`a:1:{i:0;C:11:"ArrayObject":33:{x:i:0;a:1:{i:0;i:1;};m:a:0:{}}}`,
+	`O:15:"marshalerHolder":2:{s:5:"price";s:5:"12.34";s:6:"prices";a:1:{i:0;s:4:"0.05";}}`,
+	`O:16:"structVisibility":2:{s:7:"` + "\x00*\x00" + `prot";i:1;s:25:"` + "\x00structVisibility\x00" + `private";s:1:"x";}`,
+}
+
+// decodeMalformed decodes data into many different types. It only fails if
+// decoding panics, errors are expected.
+func decodeMalformed(data []byte) {
+	var m map[interface{}]interface{}
+	phpserialize.Unmarshal(data, &m)
+
+	var s []interface{}
+	phpserialize.Unmarshal(data, &s)
+
+	var s1 struct1
+	phpserialize.Unmarshal(data, &s1)
+
+	var holder referenceHolder
+	phpserialize.Unmarshal(data, &holder)
+
+	var self selfReferencing
+	phpserialize.Unmarshal(data, &self)
+
+	var marshalers marshalerHolder
+	phpserialize.Unmarshal(data, &marshalers)
+
+	var visibility structVisibility
+	phpserialize.Unmarshal(data, &visibility)
+
+	var typed map[string][2][]int
+	phpserialize.Unmarshal(data, &typed)
+
+	var v interface{}
+	phpserialize.Unmarshal(data, &v)
+
+	var i int
+	phpserialize.Unmarshal(data, &i)
+
+	var str string
+	phpserialize.Unmarshal(data, &str)
+
+	phpserialize.DecodePHPString(data)
+
+	dec := phpserialize.NewDecoder(bytes.NewReader(data))
+	for dec.Decode(&m) == nil {
+	}
+
+	// A Decoder reads the data as it decodes it.
+	for _, target := range []interface{}{&v, &s, &s1, &holder, &self, &typed} {
+		dec = phpserialize.NewDecoder(iotest.OneByteReader(bytes.NewReader(data)))
+		dec.Decode(target)
+	}
+}
+
+func TestUnmarshalMalformed(t *testing.T) {
+	for _, data := range malformedCorpus {
+		for i := 0; i < len(data); i++ {
+			decodeMalformed([]byte(data[:i]))
+
+			for _, c := range []byte("\x00-09:;\"{}aNbidsOCrR") {
+				corrupt := []byte(data)
+				corrupt[i] = c
+				decodeMalformed(corrupt)
+			}
+		}
+	}
+}
+
+func TestUnmarshalInvalidTarget(t *testing.T) {
+	var i int
+	expectErrorToEqual(t, phpserialize.Unmarshal([]byte("i:1;"), i),
+		errors.New("can not unmarshal into non-pointer int"))
+	expectErrorToEqual(t, phpserialize.Unmarshal([]byte("i:1;"), nil),
+		errors.New("can not unmarshal into nil"))
+	expectErrorToEqual(t, phpserialize.Unmarshal([]byte("i:1;"), (*int)(nil)),
+		errors.New("can not unmarshal into nil *int"))
+}
+
+func TestUnmarshalHugeCount(t *testing.T) {
+	var result []interface{}
+	err := phpserialize.Unmarshal([]byte("a:999999999:{}"), &result)
+
+	expectErrorToEqual(t, err, errors.New(
+		`syntax error at offset 2 ($): expected count from 0 to 0, found "999999999"`))
+}
+
+func TestUnmarshalWithOptionsLimits(t *testing.T) {
+	tests := map[string]struct {
+		input         string
+		options       *phpserialize.DecodeOptions
+		expectedError error
+	}{
+		"MaxDepth": {
+			`a:1:{i:0;a:1:{i:0;a:0:{}}}`,
+			&phpserialize.DecodeOptions{MaxDepth: 2},
+			errors.New("exceeded MaxDepth of 2 at offset 20 ($[0][0])"),
+		},
+		"MaxDepthOK": {
+			`a:1:{i:0;a:1:{i:0;a:0:{}}}`,
+			&phpserialize.DecodeOptions{MaxDepth: 3},
+			nil,
+		},
+		"MaxElements": {
+			`a:2:{i:0;a:2:{i:0;N;i:1;N;}i:1;N;}`,
+			&phpserialize.DecodeOptions{MaxElements: 3},
+			errors.New("exceeded MaxElements of 3 at offset 11 ($[0])"),
+		},
+		"MaxStringLength": {
+			`a:2:{i:0;s:3:"foo";i:1;s:6:"foobar";}`,
+			&phpserialize.DecodeOptions{MaxStringLength: 5},
+			errors.New("exceeded MaxStringLength of 5 at offset 25 ($[1])"),
+		},
+		"MaxStringLengthClassName": {
+			`O:8:"stdClass":0:{}`,
+			&phpserialize.DecodeOptions{MaxStringLength: 5},
+			errors.New("exceeded MaxStringLength of 5 at offset 2 ($)"),
+		},
+		"MaxBytes": {
+			`a:2:{i:0;s:3:"foo";i:1;s:6:"foobar";}`,
+			&phpserialize.DecodeOptions{MaxBytes: 70},
+			errors.New("exceeded MaxBytes of 70 at offset 25 ($[1])"),
+		},
+		"NoLimits": {
+			`a:2:{i:0;s:3:"foo";i:1;s:6:"foobar";}`,
+			&phpserialize.DecodeOptions{},
+			nil,
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var result map[interface{}]interface{}
+			err := phpserialize.UnmarshalWithOptions([]byte(test.input),
+				&result, test.options)
+
+			if test.expectedError == nil {
+				expectErrorToNotHaveOccurred(t, err)
+			} else {
+				expectErrorToEqual(t, err, test.expectedError)
+			}
+		})
+	}
+}
+
+func TestUnmarshalDefaultMaxDepth(t *testing.T) {
+	data := strings.Repeat("a:1:{i:0;", 5000) + "N;" + strings.Repeat("}", 5000)
+
+	var result []interface{}
+	err := phpserialize.Unmarshal([]byte(data), &result)
+
+	if _, ok := err.(*phpserialize.LimitError); !ok {
+		t.Errorf("Expected *LimitError, got %v", err)
+	}
+}
+
+func TestUnmarshalListThatBecomesAssociative(t *testing.T) {
+	data := `a:1:{i:0;a:3:{i:0;s:1:"a";s:1:"x";s:1:"b";i:5;R:3;}}`
+
+	var result []interface{}
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := []interface{}{
+		map[interface{}]interface{}{int64(0): "a", "x": "b", int64(5): "a"},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %#+v, got %#+v", expected, result)
+	}
+}
+
+type sparseHolder struct {
+	Values []string
+}
+
+func TestUnmarshalSparseArrays(t *testing.T) {
+	data := `O:12:"sparseHolder":1:{s:6:"values";a:2:{i:1;s:1:"a";i:3;s:1:"b";}}`
+
+	tests := map[string]struct {
+		input         string
+		mode          phpserialize.SparseArrayMode
+		expected      []string
+		expectedError error
+	}{
+		"Error": {
+			data, phpserialize.SparseArraysError, nil,
+			errors.New("can not unmarshal associative array into Go value " +
+				"of type []string at offset 41 ($.values)"),
+		},
+		"ByOrder": {
+			data, phpserialize.SparseArraysByOrder, []string{"a", "b"}, nil,
+		},
+		"ByIndex": {
+			data, phpserialize.SparseArraysByIndex,
+			[]string{"", "a", "", "b"}, nil,
+		},
+		"ByIndexOutOfOrder": {
+			`O:12:"sparseHolder":1:{s:6:"values";a:2:{i:2;s:1:"a";i:0;s:1:"b";}}`,
+			phpserialize.SparseArraysByIndex, []string{"b", "", "a"}, nil,
+		},
+		"NegativeIndex": {
+			`O:12:"sparseHolder":1:{s:6:"values";a:1:{i:-1;s:1:"a";}}`,
+			phpserialize.SparseArraysByIndex, nil,
+			errors.New("can not unmarshal array index -1 into Go value " +
+				"of type []string at offset 41 ($.values)"),
+		},
+		"HugeIndex": {
+			`O:12:"sparseHolder":1:{s:6:"values";a:1:{i:999999999;s:1:"a";}}`,
+			phpserialize.SparseArraysByIndex, nil,
+			errors.New("can not unmarshal array index 999999999 into Go " +
+				"value of type []string at offset 41 ($.values)"),
+		},
+		"PaddedIndex": {
+			// Padding after the value can not be used to allow a huge index.
+			`O:12:"sparseHolder":1:{s:6:"values";a:1:{i:199999;s:1:"a";}}` +
+				strings.Repeat(" ", 200000),
+			phpserialize.SparseArraysByIndex, nil,
+			errors.New("can not unmarshal array index 199999 into Go " +
+				"value of type []string at offset 41 ($.values)"),
+		},
+		"StringKeys": {
+			`O:12:"sparseHolder":1:{s:6:"values";a:1:{s:1:"a";s:1:"a";}}`,
+			phpserialize.SparseArraysByOrder, nil,
+			errors.New("can not unmarshal associative array into Go value " +
+				"of type []string at offset 41 ($.values)"),
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			options := phpserialize.DefaultDecodeOptions()
+			options.SparseArrays = test.mode
+
+			var result sparseHolder
+			err := phpserialize.UnmarshalWithOptions([]byte(test.input),
+				&result, options)
+
+			if test.expectedError != nil {
+				expectErrorToEqual(t, err, test.expectedError)
+				return
+			}
+
+			expectErrorToNotHaveOccurred(t, err)
+			if !reflect.DeepEqual(result.Values, test.expected) {
+				t.Errorf("Expected %#+v, got %#+v", test.expected, result.Values)
+			}
+		})
+	}
+}
+
+func TestUnmarshalTypedContainers(t *testing.T) {
+	tests := map[string]struct {
+		input    string
+		expected interface{}
+	}{
+		"map[string]int": {
+			`a:2:{s:1:"a";i:1;i:5;i:2;}`,
+			map[string]int{"a": 1, "5": 2},
+		},
+		"map[int]string": {
+			`a:2:{i:1;s:1:"x";i:-2;s:1:"y";}`,
+			map[int]string{1: "x", -2: "y"},
+		},
+		"map[string]int from object": {
+			`O:8:"stdClass":1:{s:1:"a";i:1;}`,
+			map[string]int{"a": 1},
+		},
+		"map[string][]float64": {
+			`a:1:{s:1:"a";a:2:{i:0;d:1.5;i:1;d:2;}}`,
+			map[string][]float64{"a": {1.5, 2}},
+		},
+		"[]map[string]bool": {
+			`a:2:{i:0;a:1:{s:1:"a";b:1;}i:1;a:0:{}}`,
+			[]map[string]bool{{"a": true}, {}},
+		},
+		"[]*Struct2": {
+			`a:2:{i:0;O:7:"Struct2":1:{s:3:"qux";d:1.5;}i:1;N;}`,
+			[]*Struct2{{Qux: 1.5}, nil},
+		},
+		"map[string]Struct2": {
+			`a:1:{s:1:"a";O:7:"Struct2":1:{s:3:"qux";d:1.5;}}`,
+			map[string]Struct2{"a": {Qux: 1.5}},
+		},
+		"[3]int": {
+			`a:2:{i:0;i:1;i:1;i:2;}`,
+			[3]int{1, 2, 0},
+		},
+		"[1]int": {
+			`a:2:{i:0;i:1;i:1;a:1:{i:0;i:2;}}`,
+			[1]int{1},
+		},
+		"[2][]string": {
+			`a:2:{i:0;a:1:{i:0;s:1:"a";}i:1;a:0:{}}`,
+			[2][]string{{"a"}, {}},
+		},
+		"[][]byte": {
+			`a:1:{i:0;s:3:"foo";}`,
+			[][]byte{[]byte("foo")},
+		},
+		"interface{}": {
+			`a:1:{i:0;s:3:"foo";}`,
+			[]interface{}{"foo"},
+		},
+		"*[]uint": {
+			`a:1:{i:0;i:3;}`,
+			&[]uint{3},
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var result reflect.Value
+			if testName == "interface{}" {
+				result = reflect.New(reflect.TypeOf((*interface{})(nil)).Elem())
+			} else {
+				result = reflect.New(reflect.TypeOf(test.expected))
+			}
+
+			err := phpserialize.Unmarshal([]byte(test.input), result.Interface())
+			expectErrorToNotHaveOccurred(t, err)
+
+			if !reflect.DeepEqual(result.Elem().Interface(), test.expected) {
+				t.Errorf("Expected %#+v, got %#+v", test.expected,
+					result.Elem().Interface())
+			}
+		})
+	}
+}
+
+func TestUnmarshalTypedContainerErrors(t *testing.T) {
+	tests := map[string]struct {
+		input         string
+		target        interface{}
+		expectedError error
+	}{
+		"MapKey": {
+			`a:1:{s:1:"a";i:1;}`, &map[int]int{},
+			errors.New("can not unmarshal string into Go value of type int at offset 5 ($)"),
+		},
+		"MapValue": {
+			`a:1:{s:1:"a";a:1:{s:1:"b";s:1:"x";}}`, &map[string]map[string]int{},
+			errors.New("can not unmarshal string into Go value of type int at offset 26 ($.a.b)"),
+		},
+		"SliceElement": {
+			`a:2:{i:0;s:1:"a";i:1;i:2;}`, &[]string{},
+			errors.New("can not unmarshal int into Go value of type string at offset 21 ($[1])"),
+		},
+		"ArrayKeys": {
+			`a:1:{s:1:"a";i:1;}`, &[2]int{},
+			errors.New("can not unmarshal associative array into Go value of type [2]int at offset 5 ($)"),
+		},
+		"NotAMap": {
+			`i:1;`, &map[string]int{},
+			errors.New(`syntax error at offset 0 ($): expected array, found "i"`),
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			err := phpserialize.Unmarshal([]byte(test.input), test.target)
+			expectErrorToEqual(t, err, test.expectedError)
+		})
+	}
+}
+
+type nestedFields struct {
+	Any      interface{}
+	Count    uint
+	Items    map[string]*Struct2
+	Grid     [][]*Struct2
+	Target   interface{}
+	Existing *Struct2
+}
+
+func TestUnmarshalNestedFields(t *testing.T) {
+	data := `O:12:"nestedFields":6:{` +
+		`s:3:"any";a:1:{s:1:"a";O:8:"stdClass":1:{s:1:"b";i:1;}}` +
+		`s:5:"count";i:7;` +
+		`s:5:"items";a:1:{s:1:"x";O:7:"Struct2":1:{s:3:"qux";d:1.5;}}` +
+		`s:4:"grid";a:1:{i:0;a:2:{i:0;O:7:"Struct2":1:{s:3:"qux";d:2;}i:1;N;}}` +
+		`s:6:"target";O:7:"Struct2":1:{s:3:"qux";d:3;}` +
+		`s:8:"existing";O:7:"Struct2":1:{s:3:"qux";d:4;}}`
+
+	target := &Struct2{}
+	existing := &Struct2{}
+	result := nestedFields{Target: target, Existing: existing}
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	expected := nestedFields{
+		Any: map[interface{}]interface{}{
+			"a": map[interface{}]interface{}{"b": int64(1)},
+		},
+		Count:    7,
+		Items:    map[string]*Struct2{"x": {Qux: 1.5}},
+		Grid:     [][]*Struct2{{{Qux: 2}, nil}},
+		Target:   &Struct2{Qux: 3},
+		Existing: &Struct2{Qux: 4},
+	}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %#+v, got %#+v", expected, result)
+	}
+
+	// Pointers that were already set are decoded into.
+	if result.Target != target || result.Existing != existing {
+		t.Errorf("Expected the existing pointers to be kept")
+	}
+}
+
+func TestUnmarshalNullClearsNestedFields(t *testing.T) {
+	// Null replaces pointers, maps, slices and interfaces that are already
+	// set, so that nothing from before is left after decoding.
+	data := `O:12:"nestedFields":6:{s:3:"any";N;s:5:"count";N;s:5:"items";N;` +
+		`s:4:"grid";N;s:6:"target";N;s:8:"existing";N;}`
+
+	result := nestedFields{
+		Any:      "old",
+		Count:    7,
+		Items:    map[string]*Struct2{"x": {Qux: 1}},
+		Grid:     [][]*Struct2{{{Qux: 2}}},
+		Target:   &Struct2{Qux: 3},
+		Existing: &Struct2{Qux: 9},
+	}
+	err := phpserialize.Unmarshal([]byte(data), &result)
+	expectErrorToNotHaveOccurred(t, err)
+
+	// Values that can not be nil are left as they are.
+	expected := nestedFields{Count: 7}
+	if !reflect.DeepEqual(result, expected) {
+		t.Errorf("Expected %#+v, got %#+v", expected, result)
+	}
+}
+
+func TestUnmarshalNestedFieldErrors(t *testing.T) {
+	tests := map[string]struct {
+		input         string
+		expectedError error
+	}{
+		"Grid": {
+			`O:12:"nestedFields":1:{s:4:"grid";a:1:{i:0;a:1:{i:0;` +
+				`O:7:"Struct2":1:{s:3:"qux";s:1:"x";}}}}`,
+			errors.New("can not unmarshal string into Go value of type " +
+				"float64 at offset 79 ($.grid[0][0].qux)"),
+		},
+		"Uint": {
+			`O:12:"nestedFields":1:{s:5:"count";s:1:"x";}`,
+			errors.New("can not unmarshal string into Go value of type " +
+				"uint at offset 35 ($.count)"),
+		},
+	}
+
+	for testName, test := range tests {
+		t.Run(testName, func(t *testing.T) {
+			var result nestedFields
+			err := phpserialize.Unmarshal([]byte(test.input), &result)
+			expectErrorToEqual(t, err, test.expectedError)
+		})
+	}
+}
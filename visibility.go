@@ -0,0 +1,83 @@
+package phpserialize
+
+import "strings"
+
+// Visibility is the visibility of a property on a PHP object.
+type Visibility int
+
+const (
+	// VisibilityPublic properties are serialized with their plain name.
+	VisibilityPublic Visibility = iota
+
+	// VisibilityProtected properties are serialized as "\0*\0name".
+	VisibilityProtected
+
+	// VisibilityPrivate properties are serialized as "\0Class\0name" where
+	// Class is the name of the class that declared the property.
+	VisibilityPrivate
+)
+
+// String returns the PHP keyword for the visibility.
+func (v Visibility) String() string {
+	switch v {
+	case VisibilityProtected:
+		return "protected"
+	case VisibilityPrivate:
+		return "private"
+	default:
+		return "public"
+	}
+}
+
+// MangledPropertyName returns the name that PHP uses for a property when it
+// serializes an object. The className is only used for private properties.
+func MangledPropertyName(className, name string, visibility Visibility) string {
+	switch visibility {
+	case VisibilityProtected:
+		return "\x00*\x00" + name
+	case VisibilityPrivate:
+		return "\x00" + className + "\x00" + name
+	default:
+		return name
+	}
+}
+
+// ParsePropertyName is the opposite of MangledPropertyName. It is useful when
+// decoding objects into maps because the keys of the map will be the property
+// names exactly as PHP serialized them:
+//
+//	name, visibility, className := ParsePropertyName("\x00Foo\x00bar")
+//	// "bar", VisibilityPrivate, "Foo"
+//
+// The className is only returned for private properties. Names that are not
+// mangled are public.
+func ParsePropertyName(key string) (name string, visibility Visibility, className string) {
+	if !strings.HasPrefix(key, "\x00") {
+		return key, VisibilityPublic, ""
+	}
+
+	i := strings.IndexByte(key[1:], 0)
+	if i < 0 {
+		return key, VisibilityPublic, ""
+	}
+
+	className, name = key[1:i+1], key[i+2:]
+	if className == "*" {
+		return name, VisibilityProtected, ""
+	}
+
+	return name, VisibilityPrivate, className
+}
+
+// visibility returns the visibility described by the "private" and
+// "protected" tag options.
+func (o tagOptions) visibility() Visibility {
+	switch {
+	case o.Contains("private"):
+		return VisibilityPrivate
+	case o.Contains("protected"):
+		return VisibilityProtected
+	default:
+		return VisibilityPublic
+	}
+}
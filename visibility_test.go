@@ -0,0 +1,69 @@
+package phpserialize_test
+
+import (
+	"testing"
+
+	"github.com/elliotchance/phpserialize"
+)
+
+var propertyNameTests = map[string]struct {
+	key        string
+	name       string
+	visibility phpserialize.Visibility
+	className  string
+}{
+	"public":    {"foo", "foo", phpserialize.VisibilityPublic, ""},
+	"protected": {"\x00*\x00foo", "foo", phpserialize.VisibilityProtected, ""},
+	"private":   {"\x00Bar\x00foo", "foo", phpserialize.VisibilityPrivate, "Bar"},
+	"namespaced private": {
+		"\x00App\\Bar\x00foo", "foo", phpserialize.VisibilityPrivate, "App\\Bar",
+	},
+}
+
+func TestParsePropertyName(t *testing.T) {
+	for testName, test := range propertyNameTests {
+		t.Run(testName, func(t *testing.T) {
+			name, visibility, className := phpserialize.ParsePropertyName(test.key)
+
+			if name != test.name || visibility != test.visibility ||
+				className != test.className {
+				t.Errorf("Expected %q, %v, %q; got %q, %v, %q", test.name,
+					test.visibility, test.className, name, visibility, className)
+			}
+		})
+	}
+}
+
+func TestParsePropertyNameWithoutSecondNull(t *testing.T) {
+	name, visibility, className := phpserialize.ParsePropertyName("\x00foo")
+
+	if name != "\x00foo" || visibility != phpserialize.VisibilityPublic ||
+		className != "" {
+		t.Errorf("Unexpected result: %q, %v, %q", name, visibility, className)
+	}
+}
+
+func TestMangledPropertyName(t *testing.T) {
+	for testName, test := range propertyNameTests {
+		t.Run(testName, func(t *testing.T) {
+			key := phpserialize.MangledPropertyName(test.className, test.name,
+				test.visibility)
+
+			if key != test.key {
+				t.Errorf("Expected %q, got %q", test.key, key)
+			}
+		})
+	}
+}
+
+func TestVisibilityString(t *testing.T) {
+	for visibility, expected := range map[phpserialize.Visibility]string{
+		phpserialize.VisibilityPublic:    "public",
+		phpserialize.VisibilityProtected: "protected",
+		phpserialize.VisibilityPrivate:   "private",
+	} {
+		if visibility.String() != expected {
+			t.Errorf("Expected %s, got %s", expected, visibility)
+		}
+	}
+}